@@ -4,16 +4,26 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 // GET /admin/files
 func AdminListFiles(c *gin.Context) {
+	p, err := parsePage(c, "files", fileSortColumns, "created_at")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q := DB.Model(&File{}).Session(&gorm.Session{})
+	var total int64
+	q.Count(&total)
 	var files []File
-	if err := DB.Preload("Uploader").Find(&files).Error; err != nil {
+	if err := p.apply(q).Preload("Uploader").Preload("Tags").Find(&files).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not fetch files"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"files": files})
+	files, next := pageOf(p, files, fileSortKey(p.Sort))
+	c.JSON(http.StatusOK, gin.H{"files": files, "total": total, "next_cursor": next})
 }
 
 // GET /admin/stats
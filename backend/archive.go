@@ -0,0 +1,278 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// archiveWriter streams entries into a zip or tar.gz archive.
+type archiveWriter interface {
+	WriteFile(name string, size int64, modTime time.Time, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) WriteFile(name string, size int64, modTime time.Time, r io.Reader) error {
+	// archive/zip writes a data descriptor for streamed entries and switches
+	// to ZIP64 records by itself once an entry or the archive passes 4 GB.
+	hdr := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime,
+	}
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzArchive) WriteFile(name string, size int64, modTime time.Time, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.CopyN(a.tw, r, size)
+	return err
+}
+
+func (a *tarGzArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		a.gz.Close()
+		return err
+	}
+	return a.gz.Close()
+}
+
+// archiveFormats maps the accepted format names to content type and extension.
+var archiveFormats = map[string]struct{ ContentType, Ext string }{
+	"zip":    {"application/zip", ".zip"},
+	"tar.gz": {"application/gzip", ".tar.gz"},
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case "zip":
+		return &zipArchive{zw: zip.NewWriter(w)}, nil
+	case "tar.gz", "tgz":
+		gz := gzip.NewWriter(w)
+		return &tarGzArchive{gz: gz, tw: tar.NewWriter(gz)}, nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %q", format)
+}
+
+// archiveEntry is one file placed at Name inside an archive.
+type archiveEntry struct {
+	Name string
+	File File
+}
+
+// archiveNames hands out unique entry names, appending " (n)" before the
+// extension when two entries would otherwise collide.
+type archiveNames map[string]bool
+
+func (n archiveNames) unique(name string) string {
+	name = cleanArchiveName(name)
+	if !n[strings.ToLower(name)] {
+		n[strings.ToLower(name)] = true
+		return name
+	}
+	for i := 1; ; i++ {
+		candidate := numberedName(name, i)
+		if !n[strings.ToLower(candidate)] {
+			n[strings.ToLower(candidate)] = true
+			return candidate
+		}
+	}
+}
+
+// numberedName turns "dir/report.pdf" into "dir/report (i).pdf".
+func numberedName(name string, i int) string {
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	if strings.HasSuffix(strings.ToLower(base), ".tar.gz") {
+		ext = base[len(base)-len(".tar.gz"):]
+	}
+	if ext == base {
+		// dotfiles like ".env" have no stem to number
+		ext = ""
+	}
+	stem := strings.TrimSuffix(base, ext)
+	return fmt.Sprintf("%s%s (%d)%s", dir, stem, i, ext)
+}
+
+// cleanArchiveName keeps entry names relative so archives cannot write
+// outside the directory they are extracted into.
+func cleanArchiveName(name string) string {
+	parts := strings.Split(strings.ReplaceAll(name, "\\", "/"), "/")
+	kept := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" || p == "." || p == ".." {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	if len(kept) == 0 {
+		return "unnamed"
+	}
+	return strings.Join(kept, "/")
+}
+
+// folderArchiveEntries lists the files of a folder and all of its subfolders
+// under dir inside the archive, keeping the folder structure.
+func folderArchiveEntries(folder Folder, dir string, names archiveNames) []archiveEntry {
+	return appendFolderEntries(nil, folder, dir, names, map[uint]bool{})
+}
+
+func appendFolderEntries(entries []archiveEntry, folder Folder, dir string, names archiveNames, seen map[uint]bool) []archiveEntry {
+	if seen[folder.ID] {
+		return entries
+	}
+	seen[folder.ID] = true
+
+	var files []File
+	DB.Where("folder_id = ?", folder.ID).Order("id").Find(&files)
+	for _, f := range files {
+		name := f.Filename
+		if dir != "" {
+			name = dir + "/" + f.Filename
+		}
+		entries = append(entries, archiveEntry{Name: names.unique(name), File: f})
+	}
+
+	var subfolders []Folder
+	DB.Where("parent_id = ?", folder.ID).Order("name").Find(&subfolders)
+	for _, sub := range subfolders {
+		subDir := sub.Name
+		if dir != "" {
+			subDir = dir + "/" + sub.Name
+		}
+		entries = appendFolderEntries(entries, sub, names.unique(subDir), names, seen)
+	}
+	return entries
+}
+
+// skippedEntry is a file that could not be added to an archive.
+type skippedEntry struct {
+	Name   string
+	Reason string
+}
+
+// ctxReader stops a copy as soon as the request context is cancelled, so a
+// client that disconnects mid-file does not keep the blob being read.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// streamArchive writes entries into aw one blob at a time, closing each file
+// before opening the next. Blobs that cannot be read are listed in a manifest
+// inside the archive instead of being dropped silently. Download counts are
+// bumped atomically for every entry actually written. It returns early with
+// the context error when the client goes away.
+func streamArchive(ctx context.Context, aw archiveWriter, entries []archiveEntry, names archiveNames) error {
+	var skipped []skippedEntry
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fi, err := os.Open(filepath.Join(cfg.UploadPath, e.File.Path))
+		if err != nil {
+			skipped = append(skipped, skippedEntry{Name: e.Name, Reason: "blob missing"})
+			continue
+		}
+		info, err := fi.Stat()
+		if err != nil {
+			fi.Close()
+			skipped = append(skipped, skippedEntry{Name: e.Name, Reason: "blob unreadable"})
+			continue
+		}
+		err = aw.WriteFile(e.Name, info.Size(), e.File.CreatedAt, ctxReader{ctx: ctx, r: fi})
+		fi.Close()
+		if err != nil {
+			return err
+		}
+		DB.Model(&File{}).Where("id = ?", e.File.ID).
+			UpdateColumn("download_count", gorm.Expr("download_count + 1"))
+	}
+
+	if len(skipped) > 0 {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%d of %d files could not be included:\n\n", len(skipped), len(entries))
+		for _, s := range skipped {
+			fmt.Fprintf(&b, "%s\t%s\n", s.Name, s.Reason)
+		}
+		manifest := b.String()
+		if err := aw.WriteFile(names.unique("MANIFEST.txt"), int64(len(manifest)), time.Now(), strings.NewReader(manifest)); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// sendArchive streams entries to the client as name+ext in the given format.
+// Once the first byte is out an error can no longer be reported, so failures
+// are logged and the connection is dropped, leaving the client with a
+// truncated (and detectably invalid) archive.
+func sendArchive(c *gin.Context, name, format string, entries []archiveEntry, names archiveNames) {
+	f, ok := archiveFormats[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be zip or tar.gz"})
+		return
+	}
+	aw, err := newArchiveWriter(c.Writer, format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=\""+strings.ReplaceAll(cleanArchiveName(name), "/", "_")+f.Ext+"\"")
+	c.Header("Content-Type", f.ContentType)
+	c.Status(http.StatusOK)
+
+	if err := streamArchive(c.Request.Context(), aw, entries, names); err != nil {
+		log.Printf("archive %q aborted: %v", name, err)
+		c.Abort()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type archiveRequest struct {
+	FileIDs   []uint `json:"file_ids"`
+	FolderIDs []uint `json:"folder_ids"`
+	Format    string `json:"format"` // "zip" (default) or "tar.gz"
+	Name      string `json:"name"`
+}
+
+// POST /archive  { "file_ids": [1, 2], "folder_ids": [3], "format": "tar.gz" }
+func DownloadArchiveHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+
+	var body archiveRequest
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+		return
+	}
+	if len(body.FileIDs) == 0 && len(body.FolderIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file_ids or folder_ids required"})
+		return
+	}
+	if body.Format == "" {
+		body.Format = "zip"
+	}
+	if body.Format == "tgz" {
+		body.Format = "tar.gz"
+	}
+	if _, ok := archiveFormats[body.Format]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be zip or tar.gz"})
+		return
+	}
+
+	// check every requested item before streaming anything
+	names := archiveNames{}
+	var entries []archiveEntry
+	for _, id := range body.FileIDs {
+		var file File
+		if err := DB.First(&file, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found", "file_id": id})
+			return
+		}
+		if !userHasAccessToFile(user, file) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "you do not have access to this file", "file_id": id})
+			return
+		}
+		entries = append(entries, archiveEntry{Name: names.unique(file.Filename), File: file})
+	}
+	for _, id := range body.FolderIDs {
+		var folder Folder
+		if err := DB.First(&folder, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "folder not found", "folder_id": id})
+			return
+		}
+		if !userHasAccessToFolder(user, folder) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "you do not have access to this folder", "folder_id": id})
+			return
+		}
+		entries = append(entries, folderArchiveEntries(folder, names.unique(folder.Name), names)...)
+	}
+	if len(entries) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "nothing to download"})
+		return
+	}
+
+	name := body.Name
+	if name == "" {
+		name = "files"
+	}
+	sendArchive(c, name, body.Format, entries, names)
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -15,6 +16,15 @@ type Config struct {
 	StorageQuota    int64
 	RateLimitPerSec float64
 	RateLimitBurst  int
+	PublicBaseURL   string
+	SignedURLKey    string
+	SignedURLMaxTTL int64
+	WebDAVPassword  string
+	SFTPPort        string
+	SFTPHostKey     string
+	TrashRetention  int
+	MaxFileVersions int
+	TrustedProxies  []string
 }
 
 var cfg Config
@@ -32,6 +42,21 @@ func initConfig() {
 		StorageQuota:    mustParseInt64(getEnv("STORAGE_QUOTA_BYTES", "10485760")), // 10 MB default
 		RateLimitPerSec: mustParseFloat(getEnv("RATE_LIMIT_PER_SEC", "2")),         // 2 req/sec default
 		RateLimitBurst:  mustParseInt(getEnv("RATE_LIMIT_BURST", "4")),             // burst size
+		PublicBaseURL:   getEnv("PUBLIC_BASE_URL", ""),                             // falls back to the request host
+		SignedURLKey:    getEnv("SIGNED_URL_KEY", ""),
+		SignedURLMaxTTL: mustParseInt64(getEnv("SIGNED_URL_MAX_TTL_SECONDS", "604800")), // 7 days
+		WebDAVPassword:  getEnv("WEBDAV_PASSWORD", ""),                                  // shared Basic auth password for /webdav; unset disables Basic auth
+		SFTPPort:        getEnv("SFTP_PORT", ""),                                        // SFTP server stays off when empty
+		SFTPHostKey:     getEnv("SFTP_HOST_KEY", "./sftp_host_key"),                     // generated on first start if missing
+		TrashRetention:  mustParseInt(getEnv("TRASH_RETENTION_DAYS", "30")),             // 0 keeps trash until emptied by hand
+		MaxFileVersions: mustParseInt(getEnv("MAX_FILE_VERSIONS", "10")),                // versions kept per file, 0 keeps all
+		TrustedProxies:  splitList(getEnv("TRUSTED_PROXIES", "")),                       // X-Forwarded-For is ignored unless set
+	}
+
+	if cfg.SignedURLKey == "" {
+		// without a stable key, signed URLs stop validating after a restart
+		log.Println("SIGNED_URL_KEY not set, generating an ephemeral signing key")
+		cfg.SignedURLKey = generateToken() + generateToken()
 	}
 }
 
@@ -42,6 +67,17 @@ func getEnv(k, def string) string {
 	return def
 }
 
+// splitList reads a comma-separated setting; empty means none.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
 func mustParseInt64(s string) int64 {
 	v, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
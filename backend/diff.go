@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxDiffBytes caps each side of a text diff; larger versions only get the
+// structured comparison.
+const maxDiffBytes = 2 << 20
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// diffOp is one line of an edit script: ' ' kept, '-' removed, '+' added.
+// A and B are the line's index in the old and new text (for additions and
+// removals, the position in the other text where it happens).
+type diffOp struct {
+	Kind byte
+	Line string
+	A, B int
+}
+
+type diffPair struct {
+	x, y int
+}
+
+// splitLines splits text after each newline, keeping the newlines so a
+// missing one on the last line shows up in the diff.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffAnchors pairs up lines that occur exactly once in both texts and keeps
+// the longest run of those pairs that appears in the same order in both.
+// The texts are then only compared between anchors, which keeps the diff
+// O(n log n) and lines it up the way a reader would (as in patience diff).
+// The last pair is the end of both texts.
+func diffAnchors(a, b []string) []diffPair {
+	type count struct{ a, b, bi int }
+	counts := map[string]*count{}
+	for _, l := range a {
+		c := counts[l]
+		if c == nil {
+			c = &count{}
+			counts[l] = c
+		}
+		c.a++
+	}
+	for i, l := range b {
+		c := counts[l]
+		if c == nil {
+			c = &count{}
+			counts[l] = c
+		}
+		c.b++
+		c.bi = i
+	}
+	var seq []diffPair
+	for i, l := range a {
+		if c := counts[l]; c.a == 1 && c.b == 1 {
+			seq = append(seq, diffPair{i, c.bi})
+		}
+	}
+	return append(longestIncreasing(seq), diffPair{len(a), len(b)})
+}
+
+// longestIncreasing returns the longest subsequence of seq whose y values
+// increase, by patience sorting.
+func longestIncreasing(seq []diffPair) []diffPair {
+	var tails []int
+	prev := make([]int, len(seq))
+	for i, p := range seq {
+		k := sort.Search(len(tails), func(j int) bool { return seq[tails[j]].y >= p.y })
+		prev[i] = -1
+		if k > 0 {
+			prev[i] = tails[k-1]
+		}
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+	if len(tails) == 0 {
+		return nil
+	}
+	out := make([]diffPair, len(tails))
+	k := tails[len(tails)-1]
+	for i := len(tails) - 1; i >= 0; i-- {
+		out[i] = seq[k]
+		k = prev[k]
+	}
+	return out
+}
+
+// diffLines returns an edit script turning a into b.
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	x, y := 0, 0
+	for _, p := range diffAnchors(a, b) {
+		// between anchors: common prefix, then a block of changes, then common suffix
+		for x < p.x && y < p.y && a[x] == b[y] {
+			ops = append(ops, diffOp{' ', a[x], x, y})
+			x++
+			y++
+		}
+		ex, ey := p.x, p.y
+		for ex > x && ey > y && a[ex-1] == b[ey-1] {
+			ex--
+			ey--
+		}
+		for ; x < ex; x++ {
+			ops = append(ops, diffOp{'-', a[x], x, y})
+		}
+		for ; y < ey; y++ {
+			ops = append(ops, diffOp{'+', b[y], x, y})
+		}
+		for x < p.x {
+			ops = append(ops, diffOp{' ', a[x], x, y})
+			x++
+			y++
+		}
+		if p.x < len(a) {
+			ops = append(ops, diffOp{' ', a[p.x], p.x, p.y})
+			x, y = p.x+1, p.y+1
+		}
+	}
+	return ops
+}
+
+// unifiedDiff renders the changes from a to b in unified diff format and
+// counts the added and removed lines. Identical texts give an empty diff.
+func unifiedDiff(fromName, toName string, a, b []string) (string, int, int) {
+	ops := diffLines(a, b)
+	var out strings.Builder
+	added, removed := 0, 0
+	n := len(ops)
+	for i := 0; i < n; {
+		for i < n && ops[i].Kind == ' ' {
+			i++
+		}
+		if i == n {
+			break
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+
+		// grow the hunk while the next change is close enough to share context
+		start, end := max(i-diffContext, 0), i
+		for {
+			for end < n && ops[end].Kind != ' ' {
+				end++
+			}
+			next := end
+			for next < n && ops[next].Kind == ' ' && next-end <= 2*diffContext {
+				next++
+			}
+			if next < n && ops[next].Kind != ' ' {
+				end = next
+				continue
+			}
+			break
+		}
+		stop := min(end+diffContext, n)
+		hunk := ops[start:stop]
+
+		aCount, bCount := 0, 0
+		for _, op := range hunk {
+			if op.Kind != '+' {
+				aCount++
+			}
+			if op.Kind != '-' {
+				bCount++
+			}
+		}
+		// an empty range names the line before it, so it is not shifted to 1-based
+		aStart, bStart := hunk[0].A, hunk[0].B
+		if aCount > 0 {
+			aStart++
+		}
+		if bCount > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, op := range hunk {
+			out.WriteByte(op.Kind)
+			out.WriteString(op.Line)
+			if !strings.HasSuffix(op.Line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+			switch op.Kind {
+			case '+':
+				added++
+			case '-':
+				removed++
+			}
+		}
+		i = stop
+	}
+	return out.String(), added, removed
+}
+
+// isTextMime reports whether a detected content type can be diffed as text.
+func isTextMime(ct string) bool {
+	ct = baseMime(ct)
+	if strings.HasPrefix(ct, "text/") {
+		return true
+	}
+	switch ct {
+	case "application/json", "application/xml", "application/javascript", "application/x-sh", "application/yaml":
+		return true
+	}
+	return strings.HasSuffix(ct, "+json") || strings.HasSuffix(ct, "+xml")
+}
+
+// readVersionText loads a version's content for diffing. ok is false, with
+// the reason, when the content is binary or too large.
+func readVersionText(v FileVersion) (text string, ok bool, reason string, err error) {
+	fullPath := filepath.Join(cfg.UploadPath, v.Path)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return "", false, "", err
+	}
+	detected, err := detectMimeType(fullPath)
+	if err != nil {
+		return "", false, "", err
+	}
+	if !isTextMime(detected) {
+		return "", false, "binary content (" + baseMime(detected) + ")", nil
+	}
+	if info.Size() > maxDiffBytes {
+		return "", false, fmt.Sprintf("larger than %d bytes", maxDiffBytes), nil
+	}
+	b, err := os.ReadFile(fullPath)
+	if err != nil {
+		return "", false, "", err
+	}
+	// the sniffer only looks at the first 512 bytes
+	if bytes.IndexByte(b, 0) >= 0 {
+		return "", false, "binary content", nil
+	}
+	return string(b), true, "", nil
+}
+
+func versionSummary(v FileVersion) gin.H {
+	return gin.H{
+		"version":      v.Version,
+		"size":         v.Size,
+		"hash":         v.Hash,
+		"content_type": v.ContentType,
+		"uploader":     v.Uploader.Username,
+		"created_at":   v.CreatedAt,
+	}
+}
+
+// GET /files/:id/versions/diff?from=1&to=3  (defaults: the previous and the current version)
+func DiffFileVersionsHandler(c *gin.Context) {
+	_, file, ok := loadVersionedFile(c)
+	if !ok {
+		return
+	}
+	to := file.Version
+	if s := c.Query("to"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to version"})
+			return
+		}
+		to = n
+	}
+	from := to - 1
+	if s := c.Query("from"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from version"})
+			return
+		}
+		from = n
+	}
+	vFrom, ok := findFileVersion(file, from)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "version not found", "version": from})
+		return
+	}
+	vTo, ok := findFileVersion(file, to)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "version not found", "version": to})
+		return
+	}
+
+	resp := gin.H{
+		"file_id":    file.ID,
+		"from":       versionSummary(vFrom),
+		"to":         versionSummary(vTo),
+		"identical":  vFrom.Hash == vTo.Hash,
+		"size_delta": vTo.Size - vFrom.Size,
+	}
+
+	textFrom, okFrom, reasonFrom, err := readVersionText(vFrom)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "file missing"})
+		return
+	}
+	textTo, okTo, reasonTo, err := readVersionText(vTo)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "file missing"})
+		return
+	}
+	if !okFrom || !okTo {
+		reason := reasonFrom
+		if reason == "" {
+			reason = reasonTo
+		}
+		resp["format"] = "summary"
+		resp["reason"] = reason
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	name := file.Filename
+	diff, added, removed := unifiedDiff(
+		fmt.Sprintf("%s (version %d)", name, vFrom.Version),
+		fmt.Sprintf("%s (version %d)", name, vTo.Version),
+		splitLines(textFrom), splitLines(textTo))
+	resp["format"] = "unified"
+	resp["diff"] = diff
+	resp["lines_added"] = added
+	resp["lines_removed"] = removed
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a\n", []string{"a\n"}},
+		{"a\nb", []string{"a\n", "b"}},
+		{"a\n\nb\n", []string{"a\n", "\n", "b\n"}},
+	}
+	for _, tt := range tests {
+		got := splitLines(tt.text)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("splitLines(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name           string
+		a, b           string
+		want           string
+		added, removed int
+	}{
+		{
+			name: "identical",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name:  "from empty",
+			a:     "",
+			b:     "a\nb\n",
+			want:  "--- v1\n+++ v2\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+			added: 2,
+		},
+		{
+			name:    "to empty",
+			a:       "a\nb\n",
+			b:       "",
+			want:    "--- v1\n+++ v2\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+			removed: 2,
+		},
+		{
+			name:    "changed line",
+			a:       "a\nb\nc\n",
+			b:       "a\nB\nc\n",
+			want:    "--- v1\n+++ v2\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+			added:   1,
+			removed: 1,
+		},
+		{
+			name:  "insert in the middle",
+			a:     "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:     "1\n2\n3\n4\nnew\n5\n6\n7\n8\n",
+			want:  "--- v1\n+++ v2\n@@ -2,6 +2,7 @@\n 2\n 3\n 4\n+new\n 5\n 6\n 7\n",
+			added: 1,
+		},
+		{
+			name:  "missing newline at end",
+			a:     "a\nb",
+			b:     "a\nb\n",
+			want:  "--- v1\n+++ v2\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+			added: 1, removed: 1,
+		},
+		{
+			name: "changes far apart get separate hunks",
+			a:    "x\n1\n2\n3\n4\n5\n6\n7\n8\ny\n",
+			b:    "X\n1\n2\n3\n4\n5\n6\n7\n8\nY\n",
+			want: "--- v1\n+++ v2\n" +
+				"@@ -1,4 +1,4 @@\n-x\n+X\n 1\n 2\n 3\n" +
+				"@@ -7,4 +7,4 @@\n 6\n 7\n 8\n-y\n+Y\n",
+			added: 2, removed: 2,
+		},
+		{
+			name:  "changes close together share a hunk",
+			a:     "x\n1\n2\n3\n4\ny\n",
+			b:     "X\n1\n2\n3\n4\nY\n",
+			want:  "--- v1\n+++ v2\n@@ -1,6 +1,6 @@\n-x\n+X\n 1\n 2\n 3\n 4\n-y\n+Y\n",
+			added: 2, removed: 2,
+		},
+		{
+			name:  "moved block is anchored on unique lines",
+			a:     "func a\n}\nfunc b\n}\n",
+			b:     "func b\n}\nfunc a\n}\n",
+			want:  "--- v1\n+++ v2\n@@ -1,4 +1,4 @@\n-func a\n-}\n func b\n }\n+func a\n+}\n",
+			added: 2, removed: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, added, removed := unifiedDiff("v1", "v2", splitLines(tt.a), splitLines(tt.b))
+			if got != tt.want {
+				t.Errorf("diff:\n%s\nwant:\n%s", got, tt.want)
+			}
+			if added != tt.added || removed != tt.removed {
+				t.Errorf("counted +%d -%d, want +%d -%d", added, removed, tt.added, tt.removed)
+			}
+		})
+	}
+}
+
+// The edit script must turn a into b for any input, repeated lines included.
+func TestDiffLinesRebuildsTarget(t *testing.T) {
+	tests := [][2]string{
+		{"a\nb\nc\n", "c\nb\na\n"},
+		{"x\nx\nx\n", "x\ny\nx\n"},
+		{"}\n}\n}\na\n}\n", "a\n}\n}\nb\n}\n}\n"},
+		{"1\n2\n3\n", "4\n5\n"},
+		{"same\n", "same\n"},
+	}
+	for _, tt := range tests {
+		a, b := splitLines(tt[0]), splitLines(tt[1])
+		var fromA, toB []string
+		for _, op := range diffLines(a, b) {
+			if op.Kind != '+' {
+				fromA = append(fromA, op.Line)
+			}
+			if op.Kind != '-' {
+				toB = append(toB, op.Line)
+			}
+		}
+		if strings.Join(fromA, "") != tt[0] || strings.Join(toB, "") != tt[1] {
+			t.Errorf("diffLines(%q, %q) rebuilds %q -> %q", tt[0], tt[1], strings.Join(fromA, ""), strings.Join(toB, ""))
+		}
+	}
+}
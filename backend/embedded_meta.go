@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ledongthuc/pdf"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// extractEmbeddedMetadata reads the metadata stored inside a file: pixel
+// size and EXIF data (camera, capture time, GPS position) for images, page
+// count, title and author for PDFs. Unreadable metadata is left out, so an
+// upload never fails because of it.
+func extractEmbeddedMetadata(fullPath, contentType string) Metadata {
+	m := Metadata{}
+	ct := baseMime(contentType)
+	var err error
+	switch {
+	case strings.HasPrefix(ct, "image/"):
+		err = readImageMetadata(fullPath, m)
+	case ct == "application/pdf":
+		err = readPDFMetadata(fullPath, m)
+	}
+	if err != nil {
+		log.Printf("reading metadata of %s failed: %v", filepath.Base(fullPath), err)
+	}
+	return m
+}
+
+func readImageMetadata(fullPath string, m Metadata) error {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if cfg, format, err := image.DecodeConfig(f); err == nil {
+		m["width"], m["height"], m["format"] = cfg.Width, cfg.Height, format
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return readEXIF(f, m)
+}
+
+// readEXIF adds the EXIF fields of an image. Images without EXIF data,
+// like most PNGs and GIFs, are not an error.
+func readEXIF(r io.Reader, m Metadata) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("exif: %v", p)
+		}
+	}()
+	x, err := exif.Decode(r)
+	if err != nil {
+		return nil
+	}
+	for key, field := range map[string]exif.FieldName{
+		"camera_make":  exif.Make,
+		"camera_model": exif.Model,
+		"lens_model":   exif.LensModel,
+	} {
+		if tag, err := x.Get(field); err == nil {
+			if s, err := tag.StringVal(); err == nil {
+				if s = strings.TrimSpace(strings.TrimRight(s, "\x00")); s != "" {
+					m[key] = clipMetaString(s)
+				}
+			}
+		}
+	}
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if n, err := tag.Int(0); err == nil {
+			m["orientation"] = n
+		}
+	}
+	if _, ok := m["width"]; !ok {
+		for key, field := range map[string]exif.FieldName{"width": exif.PixelXDimension, "height": exif.PixelYDimension} {
+			if tag, err := x.Get(field); err == nil {
+				if n, err := tag.Int(0); err == nil {
+					m[key] = n
+				}
+			}
+		}
+	}
+	// the camera's local time, which EXIF stores without a zone
+	if t, err := x.DateTime(); err == nil {
+		m["taken_at"] = t.Format("2006-01-02T15:04:05")
+	}
+	if lat, long, err := x.LatLong(); err == nil && !math.IsNaN(lat) && !math.IsNaN(long) {
+		m["gps_latitude"] = math.Round(lat*1e6) / 1e6
+		m["gps_longitude"] = math.Round(long*1e6) / 1e6
+	}
+	return nil
+}
+
+// readPDFMetadata adds the page count and the title and author of the
+// document information dictionary.
+func readPDFMetadata(fullPath string, m Metadata) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("pdf: %v", p)
+		}
+	}()
+	if info, err := os.Stat(fullPath); err != nil || info.Size() > maxExtractBytes {
+		return err
+	}
+	f, r, err := pdf.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	m["pages"] = r.NumPage()
+	info := r.Trailer().Key("Info")
+	for key, name := range map[string]string{"title": "Title", "author": "Author"} {
+		if s := strings.TrimSpace(info.Key(name).Text()); s != "" {
+			m[key] = clipMetaString(s)
+		}
+	}
+	return nil
+}
+
+func clipMetaString(s string) string {
+	s = strings.ToValidUTF8(s, "")
+	if len(s) <= maxMetadataValue {
+		return s
+	}
+	s = s[:maxMetadataValue]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// locationKeys are the extracted fields that tell where a photo was taken.
+// Only the uploader sees them.
+var locationKeys = []string{"gps_latitude", "gps_longitude"}
+
+// withoutLocation returns m without the location fields.
+func withoutLocation(m Metadata) Metadata {
+	out := Metadata{}
+	for k, v := range m {
+		if !slices.Contains(locationKeys, k) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// hideLocation strips the location fields from a file shown to anyone but
+// its uploader; viewerID 0 is an anonymous caller.
+func hideLocation(f *File, viewerID uint) {
+	if viewerID == 0 || f.UploaderID != viewerID {
+		f.Extracted = withoutLocation(f.Extracted)
+	}
+}
+
+func hideLocations(files []File, viewerID uint) {
+	for i := range files {
+		hideLocation(&files[i], viewerID)
+	}
+}
+
+// viewerID returns the id of the X-User caller on routes that also serve
+// anonymous callers, or 0.
+func viewerID(c *gin.Context) uint {
+	var user User
+	if name := c.GetHeader("X-User"); name != "" {
+		DB.Where("username = ?", name).First(&user)
+	}
+	return user.ID
+}
+
+// backfillEmbeddedMetadata reads the metadata of images and PDFs uploaded
+// before it was extracted, or with all set of every one.
+func backfillEmbeddedMetadata(all bool) (updated int) {
+	var files []File
+	q := DB.Unscoped().Select("id, path, content_type").
+		Where("content_type LIKE 'image/%' OR content_type = 'application/pdf'")
+	if !all {
+		q = q.Where("extracted = '{}'")
+	}
+	if err := q.Find(&files).Error; err != nil {
+		log.Printf("metadata backfill failed: %v", err)
+		return 0
+	}
+	for _, f := range files {
+		m := extractEmbeddedMetadata(filepath.Join(cfg.UploadPath, f.Path), f.ContentType)
+		if len(m) == 0 {
+			continue
+		}
+		if err := DB.Unscoped().Model(&f).Update("extracted", m).Error; err != nil {
+			log.Printf("metadata backfill of file %d failed: %v", f.ID, err)
+			continue
+		}
+		updated++
+	}
+	return updated
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// maxFacetValues caps how many values one facet lists, most frequent first.
+const maxFacetValues = 20
+
+// sizeBuckets are the size facet's ranges; Max is exclusive and 0 means no
+// upper bound.
+var sizeBuckets = []struct {
+	Label    string
+	Min, Max int64
+}{
+	{"< 1 MB", 0, 1 << 20},
+	{"1-10 MB", 1 << 20, 10 << 20},
+	{"10-100 MB", 10 << 20, 100 << 20},
+	{"100 MB-1 GB", 100 << 20, 1 << 30},
+	{"> 1 GB", 1 << 30, 0},
+}
+
+// facetValue is one value of a facet and how many results have it. Size
+// buckets also carry their range, to fill minSize and maxSize.
+type facetValue struct {
+	Value   string `json:"value"`
+	Count   int64  `json:"count"`
+	MinSize *int64 `json:"min_size,omitempty"`
+	MaxSize *int64 `json:"max_size,omitempty"`
+}
+
+// sizeBucketSQL numbers the bucket a file's size falls into.
+func sizeBucketSQL() string {
+	var sb strings.Builder
+	sb.WriteString("CASE")
+	for i, b := range sizeBuckets[:len(sizeBuckets)-1] {
+		fmt.Fprintf(&sb, " WHEN m.size < %d THEN %d", b.Max, i)
+	}
+	fmt.Fprintf(&sb, " ELSE %d END", len(sizeBuckets)-1)
+	return sb.String()
+}
+
+// searchFacets counts the files matched by db per MIME type, uploader, tag,
+// size bucket and upload month, in a single query over the whole result set.
+func searchFacets(tx, db *gorm.DB) (map[string][]facetValue, error) {
+	matched := db.Select("files.id, files.content_type, files.uploader_id, files.size, files.created_at")
+	var rows []struct {
+		Facet string
+		Value string
+		Count int64
+	}
+	err := tx.Raw(`WITH m AS (?)
+		(SELECT 'mime' AS facet, COALESCE(NULLIF(m.content_type, ''), 'unknown') AS value, COUNT(*) AS count
+			FROM m GROUP BY 2 ORDER BY 3 DESC, 2 LIMIT ?)
+		UNION ALL
+		(SELECT 'uploader', u.username, COUNT(*)
+			FROM m JOIN users u ON u.id = m.uploader_id GROUP BY 2 ORDER BY 3 DESC, 2 LIMIT ?)
+		UNION ALL
+		(SELECT 'tag', lower(t.name), COUNT(DISTINCT m.id)
+			FROM m JOIN file_tags ft ON ft.file_id = m.id JOIN tags t ON t.id = ft.tag_id
+			GROUP BY 2 ORDER BY 3 DESC, 2 LIMIT ?)
+		UNION ALL
+		(SELECT 'size', (`+sizeBucketSQL()+`)::text, COUNT(*) FROM m GROUP BY 2)
+		UNION ALL
+		(SELECT 'month', to_char(m.created_at, 'YYYY-MM'), COUNT(*)
+			FROM m GROUP BY 2 ORDER BY 2 DESC LIMIT ?)`,
+		matched, maxFacetValues, maxFacetValues, maxFacetValues, maxFacetValues).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	facets := map[string][]facetValue{"mime": {}, "uploader": {}, "tag": {}, "size": {}, "month": {}}
+	for _, r := range rows {
+		v := facetValue{Value: r.Value, Count: r.Count}
+		if r.Facet == "size" {
+			i, _ := strconv.Atoi(r.Value)
+			b := sizeBuckets[i]
+			v.Value, v.MinSize = b.Label, &b.Min
+			if b.Max > 0 {
+				v.MaxSize = &b.Max
+			}
+		}
+		facets[r.Facet] = append(facets[r.Facet], v)
+	}
+	// UNION ALL keeps no order across branches, so sort each facet here
+	for name, values := range facets {
+		sort.SliceStable(values, func(i, j int) bool {
+			switch name {
+			case "size":
+				return *values[i].MinSize < *values[j].MinSize
+			case "month":
+				return values[i].Value > values[j].Value
+			}
+			if values[i].Count != values[j].Count {
+				return values[i].Count > values[j].Count
+			}
+			return values[i].Value < values[j].Value
+		})
+	}
+	return facets, nil
+}
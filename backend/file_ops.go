@@ -0,0 +1,603 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// fileOpError is a rename, copy, move or delete that was refused, with the
+// status to answer it with.
+type fileOpError struct {
+	Status  int
+	Message string
+}
+
+func (e *fileOpError) Error() string {
+	return e.Message
+}
+
+func opError(status int, msg string) error {
+	return &fileOpError{Status: status, Message: msg}
+}
+
+func fileOpFailed(c *gin.Context, err error) {
+	var opErr *fileOpError
+	if errors.As(err, &opErr) {
+		c.JSON(opErr.Status, gin.H{"error": opErr.Message})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// whereParent scopes q to rows whose column is id, or NULL for the root.
+func whereParent(q *gorm.DB, column string, id *uint) *gorm.DB {
+	if id == nil {
+		return q.Where(column + " IS NULL")
+	}
+	return q.Where(column+" = ?", *id)
+}
+
+// sameFolderID reports whether two folder references (nil is the root) match.
+func sameFolderID(a, b *uint) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// nameInUse reports whether a file or folder called name already sits
+// directly in folderID.
+func nameInUse(tx *gorm.DB, ownerID uint, folderID *uint, name string) bool {
+	var files, folders int64
+	whereParent(tx.Model(&File{}).Where("uploader_id = ? AND filename = ?", ownerID, name), "folder_id", folderID).Count(&files)
+	whereParent(tx.Model(&Folder{}).Where("uploader_id = ? AND name = ?", ownerID, name), "parent_id", folderID).Count(&folders)
+	return files+folders > 0
+}
+
+// freeName returns name, or "name (n)" when it is already used in folderID.
+func freeName(tx *gorm.DB, ownerID uint, folderID *uint, name string) string {
+	candidate := name
+	for i := 1; nameInUse(tx, ownerID, folderID, candidate); i++ {
+		candidate = numberedName(name, i)
+	}
+	return candidate
+}
+
+// checkTargetFolder makes sure files may be put into folderID (nil is the root).
+func checkTargetFolder(tx *gorm.DB, user User, folderID *uint, verb string) error {
+	if folderID == nil {
+		return nil
+	}
+	var folder Folder
+	if err := tx.First(&folder, *folderID).Error; err != nil {
+		return opError(http.StatusNotFound, "folder not found")
+	}
+	if folder.UploaderID != user.ID && user.Username != "admin" {
+		return opError(http.StatusForbidden, "cannot "+verb+" into folder you don't own")
+	}
+	return nil
+}
+
+func renameFile(tx *gorm.DB, user User, file *File, name string) error {
+	if file.UploaderID != user.ID {
+		return opError(http.StatusForbidden, "only uploader can rename file")
+	}
+	name = strings.TrimSpace(name)
+	if !validFolderName(name) {
+		return opError(http.StatusBadRequest, "invalid file name")
+	}
+	// a second entry with the name would make /fs and WebDAV paths ambiguous
+	if name != file.Filename && nameInUse(tx, user.ID, file.FolderID, name) {
+		return opError(http.StatusConflict, "a file or folder with this name already exists there")
+	}
+	if err := tx.Model(file).Update("filename", name).Error; err != nil {
+		return err
+	}
+	file.Filename = name
+	return nil
+}
+
+func moveFile(tx *gorm.DB, user User, file *File, folderID *uint) error {
+	if file.UploaderID != user.ID {
+		return opError(http.StatusForbidden, "only uploader can move file")
+	}
+	if err := checkTargetFolder(tx, user, folderID, "move"); err != nil {
+		return err
+	}
+	if !sameFolderID(file.FolderID, folderID) && nameInUse(tx, user.ID, folderID, file.Filename) {
+		return opError(http.StatusConflict, "a file or folder with this name already exists there")
+	}
+	if err := checkMoveRetained([]File{*file}, file.FolderID, folderID); err != nil {
+		return err
+	}
+	if err := checkFolderMetadata(tx, []File{*file}, folderID); err != nil {
+		return err
+	}
+	if err := tx.Model(file).Update("folder_id", folderID).Error; err != nil {
+		return err
+	}
+	file.FolderID = folderID
+	return nil
+}
+
+// copyFile adds a row for user pointing at the same blob as file, so a copy
+// takes no extra space. An empty name keeps the original one, numbered if
+// it is taken in the target folder.
+func copyFile(tx *gorm.DB, user User, file File, folderID *uint, name string) (File, error) {
+	if !userHasAccessToFile(user, file) {
+		return File{}, opError(http.StatusForbidden, "you do not have access to this file")
+	}
+	if err := checkTargetFolder(tx, user, folderID, "copy"); err != nil {
+		return File{}, err
+	}
+	if err := checkFolderMetadata(tx, []File{file}, folderID); err != nil {
+		return File{}, err
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		name = freeName(tx, user.ID, folderID, file.Filename)
+	} else if !validFolderName(name) {
+		return File{}, opError(http.StatusBadRequest, "invalid file name")
+	} else if nameInUse(tx, user.ID, folderID, name) {
+		return File{}, opError(http.StatusConflict, "a file or folder with this name already exists there")
+	}
+	return cloneFile(tx, file, user.ID, folderID, name)
+}
+
+func cloneFile(tx *gorm.DB, file File, ownerID uint, folderID *uint, name string) (File, error) {
+	clone := File{
+		Filename:    name,
+		ContentType: file.ContentType,
+		Size:        file.Size,
+		Hash:        file.Hash,
+		Path:        file.Path,
+		UploaderID:  ownerID,
+		FolderID:    folderID,
+		Metadata:    file.Metadata,
+		Extracted:   file.Extracted,
+	}
+	// a copy of someone else's photo does not tell where it was taken
+	hideLocation(&clone, file.UploaderID)
+	if err := tx.Create(&clone).Error; err != nil {
+		return File{}, err
+	}
+	if err := copyFileTags(tx, file, clone); err != nil {
+		return File{}, err
+	}
+	syncBlobRefCount(tx, clone.Hash, clone.Path)
+	tx.First(&clone, clone.ID)
+	return clone, nil
+}
+
+func renameFolder(tx *gorm.DB, user User, folder *Folder, name string) error {
+	if folder.UploaderID != user.ID {
+		return opError(http.StatusForbidden, "only owner can rename folder")
+	}
+	name = strings.TrimSpace(name)
+	if !validFolderName(name) {
+		return opError(http.StatusBadRequest, "invalid folder name")
+	}
+	if name != folder.Name && nameInUse(tx, user.ID, folder.ParentID, name) {
+		return opError(http.StatusConflict, "a file or folder with this name already exists there")
+	}
+	if err := tx.Model(folder).Update("name", name).Error; err != nil {
+		return err
+	}
+	folder.Name = name
+	return nil
+}
+
+func moveFolder(tx *gorm.DB, user User, folder *Folder, parentID *uint) error {
+	if folder.UploaderID != user.ID {
+		return opError(http.StatusForbidden, "only owner can move folder")
+	}
+	if parentID != nil {
+		var parent Folder
+		if err := tx.First(&parent, *parentID).Error; err != nil {
+			return opError(http.StatusNotFound, "parent folder not found")
+		}
+		if parent.UploaderID != user.ID {
+			return opError(http.StatusForbidden, "cannot move into folder you don't own")
+		}
+		// the new parent must not be the folder itself or anything below it
+		for _, d := range folderDescendantIDs(folder.ID) {
+			if d == parent.ID {
+				return opError(http.StatusConflict, "cannot move a folder into itself or its subfolders")
+			}
+		}
+	}
+	if !sameFolderID(folder.ParentID, parentID) && nameInUse(tx, user.ID, parentID, folder.Name) {
+		return opError(http.StatusConflict, "a file or folder with this name already exists there")
+	}
+	var files []File
+	tx.Where("folder_id IN ?", folderDescendantIDs(folder.ID)).Find(&files)
+	if err := checkMoveRetained(files, folder.ParentID, parentID); err != nil {
+		return err
+	}
+	if err := checkMovedFolderMetadata(tx, *folder, files, parentID); err != nil {
+		return err
+	}
+	if err := tx.Model(folder).Update("parent_id", parentID).Error; err != nil {
+		return err
+	}
+	folder.ParentID = parentID
+	return nil
+}
+
+// copyFolder recreates folder and everything below it under parentID for
+// user. Files are cloned like copyFile does.
+func copyFolder(tx *gorm.DB, user User, folder Folder, parentID *uint, name string) (Folder, []File, error) {
+	if !userHasAccessToFolder(user, folder) {
+		return Folder{}, nil, opError(http.StatusForbidden, "you do not have access to this folder")
+	}
+	if parentID != nil {
+		var parent Folder
+		if err := tx.First(&parent, *parentID).Error; err != nil {
+			return Folder{}, nil, opError(http.StatusNotFound, "parent folder not found")
+		}
+		if parent.UploaderID != user.ID {
+			return Folder{}, nil, opError(http.StatusForbidden, "cannot copy into folder you don't own")
+		}
+		for _, d := range folderDescendantIDs(folder.ID) {
+			if d == parent.ID {
+				return Folder{}, nil, opError(http.StatusConflict, "cannot copy a folder into itself or its subfolders")
+			}
+		}
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		name = freeName(tx, user.ID, parentID, folder.Name)
+	} else if !validFolderName(name) {
+		return Folder{}, nil, opError(http.StatusBadRequest, "invalid folder name")
+	} else if nameInUse(tx, user.ID, parentID, name) {
+		return Folder{}, nil, opError(http.StatusConflict, "a file or folder with this name already exists there")
+	}
+	// schemas stay with the original folders, so every copy comes under the
+	// new parent's
+	var files []File
+	tx.Where("folder_id IN ?", folderDescendantIDs(folder.ID)).Find(&files)
+	if err := checkFolderMetadata(tx, files, parentID); err != nil {
+		return Folder{}, nil, err
+	}
+
+	root := Folder{Name: name, ParentID: parentID, UploaderID: user.ID}
+	if err := tx.Create(&root).Error; err != nil {
+		return Folder{}, nil, err
+	}
+	files, err := copyFolderContents(tx, user.ID, folder.ID, root.ID)
+	if err != nil {
+		return Folder{}, nil, err
+	}
+	return root, files, nil
+}
+
+func copyFolderContents(tx *gorm.DB, ownerID, srcID, dstID uint) ([]File, error) {
+	var copied []File
+	var files []File
+	tx.Where("folder_id = ?", srcID).Order("id").Find(&files)
+	for _, f := range files {
+		clone, err := cloneFile(tx, f, ownerID, &dstID, f.Filename)
+		if err != nil {
+			return nil, err
+		}
+		copied = append(copied, clone)
+	}
+
+	var subfolders []Folder
+	tx.Where("parent_id = ?", srcID).Order("name").Find(&subfolders)
+	for _, sub := range subfolders {
+		dst := Folder{Name: sub.Name, ParentID: &dstID, UploaderID: ownerID}
+		if err := tx.Create(&dst).Error; err != nil {
+			return nil, err
+		}
+		files, err := copyFolderContents(tx, ownerID, sub.ID, dst.ID)
+		if err != nil {
+			return nil, err
+		}
+		copied = append(copied, files...)
+	}
+	return copied, nil
+}
+
+// POST /files/:id/rename  { "filename": "report-final.pdf" }
+func RenameFileHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+	var body struct {
+		Filename string `json:"filename"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+		return
+	}
+	var file File
+	if err := DB.First(&file, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+	if err := renameFile(DB, user, &file, body.Filename); err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "renamed", "file": file})
+}
+
+// POST /files/:id/copy  { "folder_id": 2, "filename": "copy.pdf" }  (both optional)
+func CopyFileHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+	var body struct {
+		FolderID *uint  `json:"folder_id"`
+		Filename string `json:"filename"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+			return
+		}
+	}
+	var file File
+	if err := DB.First(&file, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	var clone File
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		clone, err = copyFile(tx, user, file, body.FolderID, body.Filename)
+		return err
+	})
+	if err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	notifyUpload(clone.ID, clone.Filename)
+	c.JSON(http.StatusCreated, gin.H{"status": "copied", "file": clone})
+}
+
+// POST /folders/:id/rename  { "name": "q4" }
+func RenameFolderHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder id"})
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+		return
+	}
+	var folder Folder
+	if err := DB.First(&folder, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+	if err := renameFolder(DB, user, &folder, body.Name); err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "renamed", "folder": folder})
+}
+
+// POST /folders/:id/copy  { "parent_id": 4, "name": "q3 backup" }  (both optional)
+func CopyFolderHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder id"})
+		return
+	}
+	var body struct {
+		ParentID *uint  `json:"parent_id"`
+		Name     string `json:"name"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+			return
+		}
+	}
+	var folder Folder
+	if err := DB.First(&folder, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+
+	var copied Folder
+	var files []File
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		copied, files, err = copyFolder(tx, user, folder, body.ParentID, body.Name)
+		return err
+	})
+	if err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	for _, f := range files {
+		notifyUpload(f.ID, f.Filename)
+	}
+	c.JSON(http.StatusCreated, gin.H{"status": "copied", "folder": copied, "files_copied": len(files)})
+}
+
+type batchRequest struct {
+	Action    string `json:"action"` // "move", "copy" or "delete"
+	FileIDs   []uint `json:"file_ids"`
+	FolderIDs []uint `json:"folder_ids"`
+	FolderID  *uint  `json:"folder_id"` // destination of move and copy; null is the root
+	Mode      string `json:"mode"`      // folder deletes: "recursive", "detach" or empty-only
+}
+
+var errBatchFailed = errors.New("batch failed")
+
+// batchItem applies the batch action to one file or folder inside tx. New
+// copies are appended to created so they can be announced after commit.
+func batchItem(tx *gorm.DB, user User, body batchRequest, kind string, id uint, created *[]File) (gin.H, error) {
+	if kind == "file" {
+		var file File
+		if err := tx.First(&file, id).Error; err != nil {
+			return nil, opError(http.StatusNotFound, "file not found")
+		}
+		switch body.Action {
+		case "move":
+			if err := moveFile(tx, user, &file, body.FolderID); err != nil {
+				return nil, err
+			}
+			return gin.H{"status": "moved"}, nil
+		case "copy":
+			clone, err := copyFile(tx, user, file, body.FolderID, "")
+			if err != nil {
+				return nil, err
+			}
+			*created = append(*created, clone)
+			return gin.H{"status": "copied", "new_id": clone.ID}, nil
+		default:
+			if file.UploaderID != user.ID {
+				return nil, opError(http.StatusForbidden, "only uploader can delete")
+			}
+			if err := checkFileDeletable(file); err != nil {
+				return nil, err
+			}
+			if err := tx.Delete(&file).Error; err != nil {
+				return nil, err
+			}
+			return gin.H{"status": "deleted"}, nil
+		}
+	}
+
+	var folder Folder
+	if err := tx.First(&folder, id).Error; err != nil {
+		return nil, opError(http.StatusNotFound, "folder not found")
+	}
+	switch body.Action {
+	case "move":
+		if err := moveFolder(tx, user, &folder, body.FolderID); err != nil {
+			return nil, err
+		}
+		return gin.H{"status": "moved"}, nil
+	case "copy":
+		copied, files, err := copyFolder(tx, user, folder, body.FolderID, "")
+		if err != nil {
+			return nil, err
+		}
+		*created = append(*created, files...)
+		return gin.H{"status": "copied", "new_id": copied.ID}, nil
+	default:
+		if folder.UploaderID != user.ID {
+			return nil, opError(http.StatusForbidden, "only owner can delete folder")
+		}
+		res, err := deleteFolder(tx, folder, body.Mode)
+		if err != nil {
+			return nil, err
+		}
+		return gin.H{"status": "deleted", "files_deleted": res.FilesDeleted}, nil
+	}
+}
+
+// POST /batch  { "action": "move", "file_ids": [1, 2], "folder_ids": [3], "folder_id": 7 }
+//
+// All items are applied in one transaction: if any of them fails, nothing
+// is changed and the per-item results say which ones failed and why.
+func BatchHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	var body batchRequest
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+		return
+	}
+	if body.Action != "move" && body.Action != "copy" && body.Action != "delete" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "action must be move, copy or delete"})
+		return
+	}
+	if body.Mode != "" && body.Mode != folderDeleteRecursive && body.Mode != folderDeleteDetach {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be recursive or detach"})
+		return
+	}
+	if len(body.FileIDs) == 0 && len(body.FolderIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file_ids or folder_ids required"})
+		return
+	}
+
+	results := make([]gin.H, 0, len(body.FileIDs)+len(body.FolderIDs))
+	var created []File
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		failed := false
+		apply := func(kind string, id uint) {
+			// a savepoint per item keeps one failed statement from aborting
+			// the rest of the transaction, so every item gets a result
+			tx.SavePoint("batch_item")
+			res, err := batchItem(tx, user, body, kind, id, &created)
+			if err != nil {
+				tx.RollbackTo("batch_item")
+				failed = true
+				res = gin.H{"error": err.Error()}
+				var opErr *fileOpError
+				if errors.As(err, &opErr) {
+					res["code"] = opErr.Status
+				}
+			}
+			res["type"] = kind
+			res["id"] = id
+			results = append(results, res)
+		}
+		for _, id := range body.FileIDs {
+			apply("file", id)
+		}
+		for _, id := range body.FolderIDs {
+			apply("folder", id)
+		}
+		if failed {
+			return errBatchFailed
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "batch rolled back, nothing was changed", "results": results})
+		return
+	}
+
+	for _, f := range created {
+		notifyUpload(f.ID, f.Filename)
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "action": body.Action, "results": results})
+}
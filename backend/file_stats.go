@@ -20,6 +20,7 @@ func FileStatsHandler(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
 		return
 	}
+	hideLocation(&f, viewerID(c))
 	c.JSON(http.StatusOK, gin.H{
 		"id":             f.ID,
 		"filename":       f.Filename,
@@ -29,5 +30,7 @@ func FileStatsHandler(c *gin.Context) {
 		"ref_count":      f.RefCount,
 		"download_count": f.DownloadCount,
 		"public":         f.Public,
+		"content_type":   f.ContentType,
+		"extracted":      f.Extracted,
 	})
 }
@@ -2,11 +2,10 @@ package main
 
 import (
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func ListFilesHandler(c *gin.Context) {
@@ -17,20 +16,30 @@ func ListFilesHandler(c *gin.Context) {
 		return
 	}
 
+	p, err := parsePage(c, "files", fileSortColumns, "created_at")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q := DB.Model(&File{}).Where("uploader_id = ?", user.ID).Session(&gorm.Session{})
+	var total int64
+	q.Count(&total)
 	var files []File
-	DB.Where("uploader_id = ?", user.ID).Find(&files)
-	c.JSON(http.StatusOK, gin.H{"files": files})
+	p.apply(q).Preload("Tags").Find(&files)
+	files, next := pageOf(p, files, fileSortKey(p.Sort))
+	c.JSON(http.StatusOK, gin.H{"files": files, "total": total, "next_cursor": next})
 }
 
 func GetFileHandler(c *gin.Context) {
 	fid, _ := strconv.Atoi(c.Param("id"))
 	var file File
-	if err := DB.Preload("Uploader").First(&file, fid).Error; err != nil {
+	if err := DB.Preload("Uploader").Preload("Tags").First(&file, fid).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
 		return
 	}
 
 	if file.Public {
+		hideLocation(&file, viewerID(c))
 		c.JSON(http.StatusOK, gin.H{"file": file})
 		return
 	}
@@ -43,6 +52,7 @@ func GetFileHandler(c *gin.Context) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "you do not have access to this file"})
 		return
 	}
+	hideLocation(&file, user.ID)
 	c.JSON(http.StatusOK, gin.H{"file": file})
 }
 
@@ -67,17 +77,25 @@ func DeleteFileHandler(c *gin.Context) {
 		return
 	}
 
-	// delete the record
-	DB.Delete(&file)
-
-	// check if any references remain
-	var count int64
-	DB.Model(&File{}).Where("hash = ?", file.Hash).Count(&count)
-	if count == 0 {
-		os.Remove(filepath.Join(cfg.UploadPath, file.Path))
-	} else {
-		DB.Model(&File{}).Where("hash = ?", file.Hash).Update("ref_count", count)
+	if err := deleteFileRecord(file); err != nil {
+		fileOpFailed(c, err)
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
 }
+
+// deleteFileRecord moves the file to the trash, unless a legal hold or
+// retention rule forbids it. Its blob stays on disk until the file is purged.
+func deleteFileRecord(file File) error {
+	if err := checkFileDeletable(file); err != nil {
+		return err
+	}
+	return DB.Delete(&file).Error
+}
+
+// purgeFileRecord removes the metadata row for good and drops its blobs from
+// disk once no other row references them.
+func purgeFileRecord(file File) error {
+	return purgeFiles([]File{file})
+}
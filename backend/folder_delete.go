@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Folder deletion modes. With neither, only an empty folder can be deleted.
+const (
+	folderDeleteRecursive = "recursive" // delete everything below the folder
+	folderDeleteDetach    = "detach"    // move the contents up to the folder's parent
+)
+
+// folderDeletion summarises what deleteFolder did.
+type folderDeletion struct {
+	FoldersDeleted int
+	FilesDeleted   int
+	FoldersMoved   int
+	FilesMoved     int
+}
+
+// deleteFolder removes folder inside tx according to mode. Files deleted
+// recursively go to the trash and are restored to the root. Share grants and
+// share links of every removed folder are deleted with it, which also ends
+// any public link since the public token lives on the removed row.
+func deleteFolder(tx *gorm.DB, folder Folder, mode string) (folderDeletion, error) {
+	var res folderDeletion
+	ids := []uint{folder.ID}
+
+	switch mode {
+	case folderDeleteRecursive:
+		ids = folderDescendantIDs(folder.ID)
+		if err := checkFolderDeletable(tx, ids, true); err != nil {
+			return res, err
+		}
+		result := tx.Where("folder_id IN ?", ids).Delete(&File{})
+		if result.Error != nil {
+			return res, result.Error
+		}
+		res.FilesDeleted = int(result.RowsAffected)
+
+	case folderDeleteDetach:
+		if err := checkFolderDeletable(tx, ids, false); err != nil {
+			return res, err
+		}
+		folders, files := listFolderChildren(folder.UploaderID, &folder.ID)
+		for _, sub := range folders {
+			name := freeName(tx, sub.UploaderID, folder.ParentID, sub.Name)
+			if err := tx.Model(&sub).Updates(map[string]interface{}{"parent_id": folder.ParentID, "name": name}).Error; err != nil {
+				return res, err
+			}
+		}
+		for _, f := range files {
+			name := freeName(tx, f.UploaderID, folder.ParentID, f.Filename)
+			if err := tx.Model(&f).Updates(map[string]interface{}{"folder_id": folder.ParentID, "filename": name}).Error; err != nil {
+				return res, err
+			}
+		}
+		res.FoldersMoved = len(folders)
+		res.FilesMoved = len(files)
+
+	default:
+		var children, files int64
+		tx.Model(&Folder{}).Where("parent_id = ?", folder.ID).Count(&children)
+		tx.Model(&File{}).Where("folder_id = ?", folder.ID).Count(&files)
+		if children+files > 0 {
+			return res, opError(http.StatusConflict, "folder not empty")
+		}
+		if err := checkFolderDeletable(tx, ids, false); err != nil {
+			return res, err
+		}
+	}
+
+	if err := tx.Exec("DELETE FROM shared_folder_access WHERE folder_id IN ?", ids).Error; err != nil {
+		return res, err
+	}
+	if err := tx.Where("folder_id IN ?", ids).Delete(&ShareLink{}).Error; err != nil {
+		return res, err
+	}
+	// one statement, so parent/child references are only checked once all are gone
+	if err := tx.Where("id IN ?", ids).Delete(&Folder{}).Error; err != nil {
+		return res, err
+	}
+	res.FoldersDeleted = len(ids)
+	return res, nil
+}
+
+// deleteFolderNow runs deleteFolder in its own transaction.
+func deleteFolderNow(folder Folder, mode string) (folderDeletion, error) {
+	var res folderDeletion
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		res, err = deleteFolder(tx, folder, mode)
+		return err
+	})
+	return res, err
+}
+
+// DELETE /folders/:id?mode=recursive|detach
+func DeleteFolderHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder id"})
+		return
+	}
+	mode := c.Query("mode")
+	if mode != "" && mode != folderDeleteRecursive && mode != folderDeleteDetach {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be recursive or detach"})
+		return
+	}
+
+	var folder Folder
+	if err := DB.First(&folder, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+	if folder.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only owner can delete folder"})
+		return
+	}
+
+	res, err := deleteFolderNow(folder, mode)
+	if err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":          "deleted",
+		"mode":            mode,
+		"folders_deleted": res.FoldersDeleted,
+		"files_deleted":   res.FilesDeleted,
+		"folders_moved":   res.FoldersMoved,
+		"files_moved":     res.FilesMoved,
+	})
+}
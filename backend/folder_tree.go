@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// folderAncestors returns the chain of folders from the root down to and
+// including the given folder.
+func folderAncestors(folderID uint) []Folder {
+	var chain []Folder
+	DB.Raw(`
+		WITH RECURSIVE chain AS (
+			SELECT folders.*, 0 AS depth FROM folders WHERE id = ?
+			UNION
+			SELECT f.*, c.depth + 1 FROM folders f JOIN chain c ON f.id = c.parent_id
+			WHERE c.depth < 256
+		)
+		SELECT id, name, parent_id, uploader_id, public, public_token, created_at
+		FROM chain ORDER BY depth DESC
+	`, folderID).Scan(&chain)
+	return chain
+}
+
+// folderDescendantIDs returns the folder's id followed by the ids of every
+// folder nested below it.
+func folderDescendantIDs(folderID uint) []uint {
+	var ids []uint
+	DB.Raw(`
+		WITH RECURSIVE tree AS (
+			SELECT id FROM folders WHERE id = ?
+			UNION
+			SELECT f.id FROM folders f JOIN tree t ON f.parent_id = t.id
+		)
+		SELECT id FROM tree
+	`, folderID).Scan(&ids)
+	return ids
+}
+
+// folderChainAccessible reports whether the user owns the folder or one of
+// its ancestors, or whether any of them is public or shared with the user.
+func folderChainAccessible(folderID, userID uint) bool {
+	var count int64
+	DB.Raw(`
+		WITH RECURSIVE chain AS (
+			SELECT id, parent_id, uploader_id, public FROM folders WHERE id = ?
+			UNION
+			SELECT f.id, f.parent_id, f.uploader_id, f.public FROM folders f JOIN chain c ON f.id = c.parent_id
+		)
+		SELECT COUNT(1) FROM chain c
+		WHERE c.public OR c.uploader_id = ?
+		   OR EXISTS (SELECT 1 FROM shared_folder_access s WHERE s.folder_id = c.id AND s.target_user_id = ?)
+	`, folderID, userID, userID).Scan(&count)
+	return count > 0
+}
+
+// validFolderName rejects names that cannot be used as a path segment.
+func validFolderName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// folderPathString renders the chain as "/a/b/c".
+func folderPathString(chain []Folder) string {
+	parts := make([]string, 0, len(chain))
+	for _, f := range chain {
+		parts = append(parts, f.Name)
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// listFolderChildren returns the subfolders and files directly inside a
+// folder, or the owner's top-level ones when folderID is nil.
+func listFolderChildren(ownerID uint, folderID *uint) ([]Folder, []File) {
+	var folders []Folder
+	var files []File
+	if folderID == nil {
+		DB.Where("uploader_id = ? AND parent_id IS NULL", ownerID).Order("name").Find(&folders)
+		DB.Where("uploader_id = ? AND folder_id IS NULL", ownerID).Order("filename").Find(&files)
+	} else {
+		DB.Where("parent_id = ?", *folderID).Order("name").Find(&folders)
+		DB.Where("folder_id = ?", *folderID).Order("filename").Find(&files)
+	}
+	return folders, files
+}
+
+// GET /folders/:id/children  (":id" may be "root")
+func ListFolderChildrenHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+
+	if c.Param("id") == "root" {
+		folders, files := listFolderChildren(user.ID, nil)
+		c.JSON(http.StatusOK, gin.H{"folder": nil, "folders": folders, "files": files})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder id"})
+		return
+	}
+	var folder Folder
+	if err := DB.First(&folder, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+	if !userHasAccessToFolder(user, folder) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you do not have access to this folder"})
+		return
+	}
+	folders, files := listFolderChildren(folder.UploaderID, &folder.ID)
+	hideLocations(files, user.ID)
+	c.JSON(http.StatusOK, gin.H{"folder": folder, "folders": folders, "files": files})
+}
+
+// GET /folders/:id/path
+func FolderPathHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder id"})
+		return
+	}
+	var folder Folder
+	if err := DB.First(&folder, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+	if !userHasAccessToFolder(user, folder) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you do not have access to this folder"})
+		return
+	}
+
+	chain := folderAncestors(folder.ID)
+	// users with shared access only see the part of the tree shared with them
+	for len(chain) > 1 && !userHasAccessToFolder(user, chain[0]) {
+		chain = chain[1:]
+	}
+	crumbs := make([]gin.H, 0, len(chain))
+	for _, f := range chain {
+		crumbs = append(crumbs, gin.H{"id": f.ID, "name": f.Name})
+	}
+	c.JSON(http.StatusOK, gin.H{"folder_id": folder.ID, "path": folderPathString(chain), "breadcrumbs": crumbs})
+}
+
+// POST /folders/:id/move  { "parent_id": 4 }  (null moves the folder to the root)
+func MoveFolderHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder id"})
+		return
+	}
+	var body struct {
+		ParentID *uint `json:"parent_id"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+		return
+	}
+
+	var folder Folder
+	if err := DB.First(&folder, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+	if err := moveFolder(DB, user, &folder, body.ParentID); err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "moved", "folder": folder})
+}
@@ -1,17 +1,14 @@
 package main
 
 import (
-	"archive/zip"
-	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
-// POST /folders
+// POST /folders  { "name": "q3", "parent_id": 2 }
 func CreateFolderHandler(c *gin.Context) {
 	username := c.GetHeader("X-User")
 	if username == "" {
@@ -25,15 +22,36 @@ func CreateFolderHandler(c *gin.Context) {
 	}
 
 	var body struct {
-		Name string `json:"name"`
+		Name     string `json:"name"`
+		ParentID *uint  `json:"parent_id"`
 	}
 	if err := c.BindJSON(&body); err != nil || body.Name == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "name required"})
 		return
 	}
+	if !validFolderName(body.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder name"})
+		return
+	}
+	if body.ParentID != nil {
+		var parent Folder
+		if err := DB.First(&parent, *body.ParentID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "parent folder not found"})
+			return
+		}
+		if parent.UploaderID != user.ID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "cannot create folder inside a folder you don't own"})
+			return
+		}
+	}
+	if nameInUse(DB, user.ID, body.ParentID, body.Name) {
+		c.JSON(http.StatusConflict, gin.H{"error": "a file or folder with this name already exists there"})
+		return
+	}
 
 	fold := Folder{
 		Name:       body.Name,
+		ParentID:   body.ParentID,
 		UploaderID: user.ID,
 	}
 	if err := DB.Create(&fold).Error; err != nil {
@@ -43,7 +61,7 @@ func CreateFolderHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"folder": fold})
 }
 
-// GET /folders
+// GET /folders  (smart_folders lists the caller's saved searches)
 func ListFoldersHandler(c *gin.Context) {
 	username := c.GetHeader("X-User")
 	var user User
@@ -51,9 +69,23 @@ func ListFoldersHandler(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
 		return
 	}
+	p, err := parsePage(c, "folders", folderSortColumns, "name")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q := DB.Model(&Folder{}).Where("uploader_id = ?", user.ID).Session(&gorm.Session{})
+	var total int64
+	q.Count(&total)
 	var folders []Folder
-	DB.Where("uploader_id = ?", user.ID).Find(&folders)
-	c.JSON(http.StatusOK, gin.H{"folders": folders})
+	p.apply(q).Find(&folders)
+	folders, next := pageOf(p, folders, folderSortKey(p.Sort))
+	c.JSON(http.StatusOK, gin.H{
+		"folders":       folders,
+		"total":         total,
+		"next_cursor":   next,
+		"smart_folders": userSavedSearches(user),
+	})
 }
 
 // GET /folders/:id/files
@@ -63,12 +95,22 @@ func ListFilesInFolderHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder id"})
 		return
 	}
+	p, err := parsePage(c, "files", fileSortColumns, "name")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q := DB.Model(&File{}).Where("folder_id = ?", id).Session(&gorm.Session{})
+	var total int64
+	q.Count(&total)
 	var files []File
-	DB.Where("folder_id = ?", id).Find(&files)
-	c.JSON(http.StatusOK, gin.H{"files": files})
+	p.apply(q).Preload("Tags").Find(&files)
+	files, next := pageOf(p, files, fileSortKey(p.Sort))
+	hideLocations(files, viewerID(c))
+	c.JSON(http.StatusOK, gin.H{"files": files, "total": total, "next_cursor": next})
 }
 
-// POST /files/:id/move  { "folder_id": 2 }
+// POST /files/:id/move  { "folder_id": 2 }  (null moves the file back to the root)
 func MoveFileToFolderHandler(c *gin.Context) {
 	username := c.GetHeader("X-User")
 	var user User
@@ -83,7 +125,7 @@ func MoveFileToFolderHandler(c *gin.Context) {
 		return
 	}
 	var body struct {
-		FolderID uint `json:"folder_id"`
+		FolderID *uint `json:"folder_id"`
 	}
 	if err := c.BindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
@@ -95,23 +137,10 @@ func MoveFileToFolderHandler(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
 		return
 	}
-	if file.UploaderID != user.ID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "only uploader can move file"})
-		return
-	}
-
-	var folder Folder
-	if err := DB.First(&folder, body.FolderID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
-		return
-	}
-	if folder.UploaderID != user.ID && user.Username != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "cannot move into folder you don't own"})
+	if err := moveFile(DB, user, &file, body.FolderID); err != nil {
+		fileOpFailed(c, err)
 		return
 	}
-
-	file.FolderID = &body.FolderID
-	DB.Save(&file)
 	c.JSON(http.StatusOK, gin.H{"status": "moved", "file": file})
 }
 
@@ -163,39 +192,29 @@ func ShareFolderHandler(c *gin.Context) {
 func DownloadFolderHandler(c *gin.Context) {
 	token := c.Param("token")
 	var folder Folder
-	if err := DB.Where("public_token = ?", token).First(&folder).Error; err != nil {
+	if link, ok := findShareLink(token, "folder"); ok {
+		if err := DB.First(&folder, *link.FolderID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+			return
+		}
+		if !useShareLink(c, link) {
+			return
+		}
+	} else if err := DB.Where("public_token = ?", token).First(&folder).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
 		return
 	}
 
-	var files []File
-	DB.Where("folder_id = ?", folder.ID).Find(&files)
-	if len(files) == 0 {
+	streamFolderZip(c, folder)
+}
+
+// streamFolderZip sends the folder's files to the client as a zip archive.
+func streamFolderZip(c *gin.Context, folder Folder) {
+	names := archiveNames{}
+	entries := folderArchiveEntries(folder, "", names)
+	if len(entries) == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "folder empty"})
 		return
 	}
-
-	zipName := folder.Name + ".zip"
-	c.Header("Content-Disposition", "attachment; filename=\""+zipName+"\"")
-	c.Header("Content-Type", "application/zip")
-
-	zw := zip.NewWriter(c.Writer)
-	defer zw.Close()
-
-	for _, f := range files {
-		DB.Model(&f).UpdateColumn("download_count", f.DownloadCount+1)
-
-		fullPath := filepath.Join(cfg.UploadPath, f.Path)
-		fi, err := os.Open(fullPath)
-		if err != nil {
-			continue
-		}
-		defer fi.Close()
-		info, _ := fi.Stat()
-		hdr, _ := zip.FileInfoHeader(info)
-		hdr.Name = f.Filename
-		hdr.Method = zip.Deflate
-		w, _ := zw.CreateHeader(hdr)
-		io.Copy(w, fi)
-	}
+	sendArchive(c, folder.Name, "zip", entries, names)
 }
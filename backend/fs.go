@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	errVaultNotFound = errors.New("no such file or folder")
+	errVaultBadPath  = errors.New("invalid path")
+	errVaultNotDir   = errors.New("not a folder")
+	errVaultExists   = errors.New("a file with this name already exists")
+)
+
+// vaultNode is what a vault path resolves to: the root (both nil), a folder or a file.
+type vaultNode struct {
+	Folder *Folder
+	File   *File
+}
+
+func (n vaultNode) isRoot() bool {
+	return n.Folder == nil && n.File == nil
+}
+
+// folderID is the id used as parent for children of the node (nil for the root).
+func (n vaultNode) folderID() *uint {
+	if n.Folder == nil {
+		return nil
+	}
+	return &n.Folder.ID
+}
+
+// splitVaultPath turns "/projects/q3/report.pdf" into its segments.
+func splitVaultPath(p string) ([]string, error) {
+	var segments []string
+	for _, s := range strings.Split(p, "/") {
+		switch s {
+		case "", ".":
+			continue
+		case "..":
+			return nil, errVaultBadPath
+		}
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+func findChildFolder(ownerID uint, parentID *uint, name string) (Folder, bool) {
+	var folder Folder
+	q := DB.Where("uploader_id = ? AND name = ?", ownerID, name)
+	if parentID == nil {
+		q = q.Where("parent_id IS NULL")
+	} else {
+		q = q.Where("parent_id = ?", *parentID)
+	}
+	if err := q.First(&folder).Error; err != nil {
+		return Folder{}, false
+	}
+	return folder, true
+}
+
+// findFolderFile returns the newest file with this name directly in the folder.
+func findFolderFile(ownerID uint, folderID *uint, name string) (File, bool) {
+	var file File
+	q := DB.Where("uploader_id = ? AND filename = ?", ownerID, name)
+	if folderID == nil {
+		q = q.Where("folder_id IS NULL")
+	} else {
+		q = q.Where("folder_id = ?", *folderID)
+	}
+	if err := q.Order("id DESC").First(&file).Error; err != nil {
+		return File{}, false
+	}
+	return file, true
+}
+
+// resolveVaultPath walks the user's folder tree. Folders win over files when
+// both share a name.
+func resolveVaultPath(user User, segments []string) (vaultNode, error) {
+	var node vaultNode
+	for i, name := range segments {
+		if node.File != nil {
+			return vaultNode{}, errVaultNotDir
+		}
+		if folder, ok := findChildFolder(user.ID, node.folderID(), name); ok {
+			node = vaultNode{Folder: &folder}
+			continue
+		}
+		if i == len(segments)-1 {
+			if file, ok := findFolderFile(user.ID, node.folderID(), name); ok {
+				return vaultNode{File: &file}, nil
+			}
+		}
+		return vaultNode{}, errVaultNotFound
+	}
+	return node, nil
+}
+
+// ensureVaultFolders resolves a folder path, creating missing folders along
+// the way, and returns the id of the last one (nil for the root).
+func ensureVaultFolders(user User, segments []string) (*uint, error) {
+	var parentID *uint
+	for _, name := range segments {
+		if !validFolderName(name) {
+			return nil, errVaultBadPath
+		}
+		folder, ok := findChildFolder(user.ID, parentID, name)
+		if !ok {
+			if _, taken := findFolderFile(user.ID, parentID, name); taken {
+				return nil, errVaultExists
+			}
+			folder = Folder{Name: name, ParentID: parentID, UploaderID: user.ID}
+			if err := DB.Create(&folder).Error; err != nil {
+				// lost a race with a concurrent create; use the winner
+				if existing, ok := findChildFolder(user.ID, parentID, name); ok {
+					folder = existing
+				} else {
+					return nil, err
+				}
+			}
+		}
+		id := folder.ID
+		parentID = &id
+	}
+	return parentID, nil
+}
+
+// vaultEntry describes a folder or file in fs listings and stat responses.
+func vaultEntry(dir string, node vaultNode) gin.H {
+	if node.File != nil {
+		f := node.File
+		return gin.H{
+			"type":           "file",
+			"id":             f.ID,
+			"name":           f.Filename,
+			"path":           strings.TrimRight(dir, "/") + "/" + f.Filename,
+			"size":           f.Size,
+			"content_type":   f.ContentType,
+			"hash":           f.Hash,
+			"version":        f.Version,
+			"download_count": f.DownloadCount,
+			"created_at":     f.CreatedAt,
+		}
+	}
+	if node.Folder != nil {
+		f := node.Folder
+		return gin.H{
+			"type":       "folder",
+			"id":         f.ID,
+			"name":       f.Name,
+			"path":       strings.TrimRight(dir, "/") + "/" + f.Name,
+			"created_at": f.CreatedAt,
+		}
+	}
+	return gin.H{"type": "folder", "name": "", "path": "/"}
+}
+
+func vaultPathError(c *gin.Context, err error) {
+	switch err {
+	case errVaultNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errVaultExists:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errVaultBadPath, errVaultNotDir:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "path resolution failed"})
+	}
+}
+
+// GET /fs/*path  (folders are listed, files downloaded; ?stat=1 describes either)
+func FSGetHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+	segments, err := splitVaultPath(c.Param("path"))
+	if err != nil {
+		vaultPathError(c, err)
+		return
+	}
+	node, err := resolveVaultPath(user, segments)
+	if err != nil {
+		vaultPathError(c, err)
+		return
+	}
+	dir := "/" + strings.Join(segments, "/")
+	parent := "/" + strings.Join(segments[:max(len(segments)-1, 0)], "/")
+
+	if c.Query("stat") != "" {
+		if node.isRoot() {
+			c.JSON(http.StatusOK, vaultEntry("/", node))
+			return
+		}
+		c.JSON(http.StatusOK, vaultEntry(parent, node))
+		return
+	}
+
+	if node.File != nil {
+		fullPath := filepath.Join(cfg.UploadPath, node.File.Path)
+		if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "file missing"})
+			return
+		}
+		if err := DB.Model(node.File).Update("download_count", gorm.Expr("download_count + 1")).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update download count"})
+			return
+		}
+		notifyDownload(node.File.ID, node.File.DownloadCount+1)
+		c.FileAttachment(fullPath, node.File.Filename)
+		return
+	}
+
+	folders, files := listFolderChildren(user.ID, node.folderID())
+	entries := make([]gin.H, 0, len(folders)+len(files))
+	for i := range folders {
+		entries = append(entries, vaultEntry(dir, vaultNode{Folder: &folders[i]}))
+	}
+	for i := range files {
+		entries = append(entries, vaultEntry(dir, vaultNode{File: &files[i]}))
+	}
+	c.JSON(http.StatusOK, gin.H{"path": dir, "entries": entries})
+}
+
+// PUT /fs/*path  (request body is the file content; a trailing "/" creates a folder)
+func FSPutHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+	raw := c.Param("path")
+	segments, err := splitVaultPath(raw)
+	if err != nil {
+		vaultPathError(c, err)
+		return
+	}
+	if len(segments) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path required"})
+		return
+	}
+
+	if strings.HasSuffix(raw, "/") {
+		id, err := ensureVaultFolders(user, segments)
+		if err != nil {
+			vaultPathError(c, err)
+			return
+		}
+		var folder Folder
+		DB.First(&folder, *id)
+		c.JSON(http.StatusCreated, vaultEntry("/"+strings.Join(segments[:len(segments)-1], "/"), vaultNode{Folder: &folder}))
+		return
+	}
+
+	dirSegments, name := segments[:len(segments)-1], segments[len(segments)-1]
+	folderID, err := ensureVaultFolders(user, dirSegments)
+	if err != nil {
+		vaultPathError(c, err)
+		return
+	}
+	if _, ok := findChildFolder(user.ID, folderID, name); ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "a folder with this name already exists"})
+		return
+	}
+
+	tmp := tempUploadPath(name)
+	out, err := os.Create(tmp)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "save temp failed"})
+		return
+	}
+	_, err = io.Copy(out, c.Request.Body)
+	out.Close()
+	if err != nil {
+		os.Remove(tmp)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not read body"})
+		return
+	}
+
+	declared := c.ContentType()
+	if declared == "application/x-www-form-urlencoded" {
+		// curl --data-binary default; says nothing about the content
+		declared = ""
+	}
+	dir := "/" + strings.Join(dirSegments, "/")
+
+	if existing, ok := findFolderFile(user.ID, folderID, name); ok {
+		blob, err := storeBlob(tmp, declared)
+		if err != nil {
+			uploadError(c, err)
+			return
+		}
+		updated, err := addFileVersion(existing, blob, user)
+		if err != nil {
+			fileOpFailed(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "replaced", "entry": vaultEntry(dir, vaultNode{File: &updated})})
+		return
+	}
+
+	file, status, err := ingestUpload(user, tmp, name, declared, folderID)
+	if err != nil {
+		uploadError(c, err)
+		return
+	}
+	resp := gin.H{"status": status, "entry": vaultEntry(dir, vaultNode{File: &file})}
+	if missing := missingMetadata(DB, file); missing != nil {
+		resp["missing_metadata"] = missing
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+// uploadError maps a storeBlob/ingestUpload failure onto a response.
+func uploadError(c *gin.Context, err error) {
+	var mismatch *mimeMismatchError
+	if errors.As(err, &mismatch) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error":    "MIME mismatch",
+			"declared": mismatch.Declared,
+			"detected": mismatch.Detected,
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// DELETE /fs/*path  (?recursive=1 also deletes a folder's contents)
+func FSDeleteHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+	segments, err := splitVaultPath(c.Param("path"))
+	if err != nil {
+		vaultPathError(c, err)
+		return
+	}
+	if len(segments) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot delete the root"})
+		return
+	}
+	node, err := resolveVaultPath(user, segments)
+	if err != nil {
+		vaultPathError(c, err)
+		return
+	}
+
+	if node.File != nil {
+		if err := deleteFileRecord(*node.File); err != nil {
+			fileOpFailed(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted", "path": "/" + strings.Join(segments, "/")})
+		return
+	}
+
+	mode := ""
+	if c.Query("recursive") != "" {
+		mode = folderDeleteRecursive
+	}
+	if _, err := deleteFolderNow(*node.Folder, mode); err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted", "path": "/" + strings.Join(segments, "/")})
+}
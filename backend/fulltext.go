@@ -0,0 +1,332 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxExtractBytes = 64 << 20  // larger blobs are not indexed
+	maxIndexedText  = 512 << 10 // a tsvector is limited to 1 MB
+)
+
+const docxMime = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+
+var errNotDocx = errors.New("zip is not a docx document")
+
+// extractText returns the searchable text of a stored blob and the name of
+// the extractor used. Content without an extractor gives an empty text.
+func extractText(fullPath, contentType, filename string) (string, string, error) {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return "", "", err
+	}
+	if info.Size() > maxExtractBytes {
+		return "", "", nil
+	}
+	ct := baseMime(contentType)
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	var text, extractor string
+	switch {
+	case ct == "application/pdf":
+		text, err = extractPDF(fullPath)
+		extractor = "pdf"
+	case ct == "application/zip" || ct == docxMime:
+		text, err = extractDOCX(fullPath)
+		extractor = "docx"
+		if err == errNotDocx {
+			return "", "", nil
+		}
+	case ct == "text/html":
+		text, err = extractHTML(fullPath)
+		extractor = "html"
+	case ct == "text/csv" || strings.HasPrefix(ct, "text/") && ext == ".csv":
+		text, err = extractCSV(fullPath)
+		extractor = "csv"
+	case strings.HasPrefix(ct, "text/"):
+		// plain text and Markdown are indexed as they are
+		text, err = extractPlain(fullPath)
+		extractor = "text"
+	default:
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return clipText(text), extractor, nil
+}
+
+// clipText makes text storable: valid UTF-8, no NUL bytes, and short enough
+// for a tsvector.
+func clipText(s string) string {
+	s = strings.ReplaceAll(strings.ToValidUTF8(s, ""), "\x00", "")
+	if len(s) <= maxIndexedText {
+		return s
+	}
+	s = s[:maxIndexedText]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+func extractPlain(fullPath string) (string, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, maxIndexedText+utf8.UTFMax))
+	return string(b), err
+}
+
+// extractCSV joins the fields with spaces, one record per line. Files that
+// do not parse are indexed as plain text.
+func extractCSV(fullPath string) (string, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	var sb strings.Builder
+	for sb.Len() < maxIndexedText {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return extractPlain(fullPath)
+		}
+		sb.WriteString(strings.Join(rec, " "))
+		sb.WriteByte('\n')
+	}
+	return sb.String(), nil
+}
+
+// extractHTML returns the visible text of a page, leaving out scripts and
+// styles.
+func extractHTML(fullPath string) (string, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	z := html.NewTokenizer(f)
+	var sb strings.Builder
+	skip := 0
+	for sb.Len() < maxIndexedText {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return sb.String(), nil
+			}
+			return sb.String(), z.Err()
+		case html.StartTagToken:
+			if name, _ := z.TagName(); isHiddenHTML(string(name)) {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); isHiddenHTML(string(name)) && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				if t := strings.TrimSpace(string(z.Text())); t != "" {
+					sb.WriteString(t)
+					sb.WriteByte(' ')
+				}
+			}
+		}
+	}
+	return sb.String(), nil
+}
+
+func isHiddenHTML(tag string) bool {
+	return tag == "script" || tag == "style" || tag == "noscript" || tag == "template"
+}
+
+// extractDOCX reads the paragraphs of word/document.xml.
+func extractDOCX(fullPath string) (string, error) {
+	zr, err := zip.OpenReader(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	var doc *zip.File
+	for _, f := range zr.File {
+		if f.Name == "word/document.xml" {
+			doc = f
+			break
+		}
+	}
+	if doc == nil {
+		return "", errNotDocx
+	}
+	rc, err := doc.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	d := xml.NewDecoder(rc)
+	var sb strings.Builder
+	inText := false
+	for sb.Len() < maxIndexedText {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return sb.String(), err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				sb.WriteByte('\t')
+			case "br":
+				sb.WriteByte('\n')
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				sb.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inText {
+				sb.Write(t)
+			}
+		}
+	}
+	return sb.String(), nil
+}
+
+// extractPDF returns the text of every page. The parser panics on some
+// malformed files, which is reported as an error.
+func extractPDF(fullPath string) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("pdf: %v", r)
+		}
+	}()
+	f, r, err := pdf.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	plain, err := r.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(io.LimitReader(plain, maxIndexedText+utf8.UTFMax))
+	return string(b), err
+}
+
+// indexBlob extracts a blob's text into blob_texts. Blobs are indexed once
+// per hash unless force is set.
+func indexBlob(hash, path, contentType, filename string, force bool) error {
+	if !force {
+		var n int64
+		DB.Model(&BlobText{}).Where("hash = ?", hash).Count(&n)
+		if n > 0 {
+			return nil
+		}
+	}
+	text, extractor, err := extractText(filepath.Join(cfg.UploadPath, path), contentType, filename)
+	if err != nil {
+		return err
+	}
+	row := BlobText{Hash: hash, Body: text, Extractor: extractor, IndexedAt: time.Now()}
+	return DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+}
+
+// indexFileAsync indexes a newly stored file without holding up the upload.
+func indexFileAsync(file File) {
+	go func() {
+		if err := indexBlob(file.Hash, file.Path, file.ContentType, file.Filename, false); err != nil {
+			log.Printf("indexing file %d failed: %v", file.ID, err)
+		}
+	}()
+}
+
+// reindexBlobs extracts the text of every blob behind a live file, or with
+// all unset only of those never indexed, as after upgrading an existing
+// vault.
+func reindexBlobs(all bool) (indexed, failed int) {
+	var files []File
+	q := DB.Select("DISTINCT ON (hash) hash, path, content_type, filename").Order("hash")
+	if !all {
+		q = q.Where("hash NOT IN (SELECT hash FROM blob_texts)")
+	}
+	if err := q.Find(&files).Error; err != nil {
+		log.Printf("reindex failed: %v", err)
+		return 0, 0
+	}
+	for _, f := range files {
+		if err := indexBlob(f.Hash, f.Path, f.ContentType, f.Filename, true); err != nil {
+			log.Printf("indexing blob %s failed: %v", f.Hash, err)
+			failed++
+			continue
+		}
+		indexed++
+	}
+	return indexed, failed
+}
+
+// runReindexCommand runs reindexBlobs from the command line.
+func runReindexCommand(args []string) {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	all := fs.Bool("all", false, "re-extract every blob and file, not only those never indexed")
+	fs.Parse(args)
+	indexed, failed := reindexBlobs(*all)
+	log.Printf("reindex done: %d indexed, %d failed", indexed, failed)
+	log.Printf("read embedded metadata of %d files", backfillEmbeddedMetadata(*all))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+var reindexRunning atomic.Bool
+
+// POST /admin/reindex?all=true  (without all, only blobs never indexed and
+// files whose embedded metadata was never read)
+func AdminReindexHandler(c *gin.Context) {
+	all := c.Query("all") == "true" || c.Query("all") == "1"
+	if !reindexRunning.CompareAndSwap(false, true) {
+		c.JSON(http.StatusConflict, gin.H{"error": "reindex already running"})
+		return
+	}
+	go func() {
+		defer reindexRunning.Store(false)
+		indexed, failed := reindexBlobs(all)
+		log.Printf("reindex done: %d indexed, %d failed", indexed, failed)
+		log.Printf("read embedded metadata of %d files", backfillEmbeddedMetadata(all))
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"status": "started", "all": all})
+}
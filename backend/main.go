@@ -18,6 +18,22 @@ func main() {
 		log.Printf("migration error: %v", err)
 	}
 
+	// one-off commands: `backend reindex [-all]`
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		runReindexCommand(os.Args[2:])
+		return
+	}
+
+	go runTrashJanitor()
+
+	if cfg.SFTPPort != "" {
+		go func() {
+			if err := runSFTPServer(":" + cfg.SFTPPort); err != nil {
+				log.Printf("sftp server stopped: %v", err)
+			}
+		}()
+	}
+
 	r := setupRouter()
 
 	log.Println("Backend running on :" + cfg.ServerPort)
@@ -31,6 +47,21 @@ func runMigrations() error {
 		"0003_add_tags.sql",
 		"0004_add_role.sql",
 		"0005_shared_access.sql",
+		"0006_signed_urls.sql",
+		"0007_share_links.sql",
+		"0008_nested_folders.sql",
+		"0009_ssh_keys.sql",
+		"0010_trash.sql",
+		"0011_file_versions.sql",
+		"0012_retention.sql",
+		"0013_fulltext.sql",
+		"0014_trigram.sql",
+		"0015_saved_searches.sql",
+		"0016_tags.sql",
+		"0017_metadata.sql",
+		"0018_extracted_metadata.sql",
+		"0019_signed_url_use_expiry.sql",
+		"0020_share_link_lockout.sql",
 	}
 
 	for _, filename := range migrationFiles {
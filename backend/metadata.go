@@ -0,0 +1,401 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxMetadataKeys  = 64
+	maxMetadataValue = 1024 // longest string value
+)
+
+// Metadata keys are lowercase so they read the same in meta.key search
+// parameters and query terms.
+var metadataKeyPattern = regexp.MustCompile(`^[a-z0-9_][a-z0-9_-]{0,63}$`)
+
+// Metadata is a file's custom key/value fields. Values are strings, numbers
+// or booleans. It is stored as JSONB.
+type Metadata map[string]interface{}
+
+func (m Metadata) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+func (m *Metadata) Scan(src interface{}) error {
+	*m = Metadata{}
+	return scanJSON(m, src)
+}
+
+// scanJSON decodes a json or jsonb column into dst.
+func scanJSON(dst interface{}, src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(v, dst)
+	case string:
+		return json.Unmarshal([]byte(v), dst)
+	}
+	return fmt.Errorf("cannot scan %T as JSON", src)
+}
+
+// metadataType names the type of a metadata value, or "" for values that
+// are not allowed.
+func metadataType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return ""
+}
+
+// schemaField is one key of a folder's metadata schema.
+type schemaField struct {
+	Key      string `json:"key"`
+	Type     string `json:"type"` // string, number or boolean
+	Required bool   `json:"required"`
+}
+
+type schemaFields []schemaField
+
+func (f schemaFields) Value() (driver.Value, error) {
+	if f == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(f)
+	return string(b), err
+}
+
+func (f *schemaFields) Scan(src interface{}) error {
+	*f = schemaFields{}
+	return scanJSON(f, src)
+}
+
+// check returns the required keys m lacks, or an error for a value of the
+// wrong type. Keys the schema does not list are allowed.
+func (s MetadataSchema) check(m Metadata) ([]string, error) {
+	missing := []string{}
+	for _, f := range s.Fields {
+		v, ok := m[f.Key]
+		if !ok {
+			if f.Required {
+				missing = append(missing, f.Key)
+			}
+			continue
+		}
+		if t := metadataType(v); t != f.Type {
+			return missing, fmt.Errorf("%s must be a %s, not a %s", f.Key, f.Type, t)
+		}
+	}
+	return missing, nil
+}
+
+// require turns a failed check into the error a request gets.
+func (s MetadataSchema) require(m Metadata) error {
+	missing, err := s.check(m)
+	if err != nil {
+		return opError(http.StatusBadRequest, err.Error())
+	}
+	if len(missing) > 0 {
+		return opError(http.StatusBadRequest, "missing required keys: "+strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// missingMetadata lists the required keys the file lacks under its
+// folder's schema, or nil when the folder has none. Uploads cannot carry
+// metadata, so they are accepted and report what is still to be set.
+func missingMetadata(tx *gorm.DB, file File) []string {
+	s := folderMetadataSchema(tx, file.FolderID)
+	if s == nil {
+		return nil
+	}
+	missing, _ := s.check(file.Metadata)
+	return missing
+}
+
+// checkFolderMetadata refuses putting files into folderID when their
+// metadata does not satisfy its schema.
+func checkFolderMetadata(tx *gorm.DB, files []File, folderID *uint) error {
+	s := folderMetadataSchema(tx, folderID)
+	if s == nil {
+		return nil
+	}
+	for _, f := range files {
+		if err := s.require(f.Metadata); err != nil {
+			return opError(http.StatusBadRequest, f.Filename+": "+err.Error())
+		}
+	}
+	return nil
+}
+
+// checkMovedFolderMetadata is checkFolderMetadata for the files below a
+// folder moving to parentID. Files under a schema inside the moved tree
+// keep it; the others come under the new parent's schema.
+func checkMovedFolderMetadata(tx *gorm.DB, folder Folder, files []File, parentID *uint) error {
+	if folderMetadataSchema(tx, parentID) == nil || len(files) == 0 {
+		return nil
+	}
+	var own []uint
+	tx.Model(&MetadataSchema{}).Where("folder_id IN ?", folderDescendantIDs(folder.ID)).Pluck("folder_id", &own)
+	var unschemed []File
+	for _, f := range files {
+		governed := false
+		// the chain runs from the root down to the file's folder
+		chain := folderAncestors(*f.FolderID)
+		for i := len(chain) - 1; i >= 0 && !governed; i-- {
+			governed = slices.Contains(own, chain[i].ID)
+			if chain[i].ID == folder.ID {
+				break
+			}
+		}
+		if !governed {
+			unschemed = append(unschemed, f)
+		}
+	}
+	return checkFolderMetadata(tx, unschemed, parentID)
+}
+
+// folderMetadataSchema returns the schema of the folder or, failing that,
+// of its nearest ancestor that has one. Files at the root have none.
+func folderMetadataSchema(tx *gorm.DB, folderID *uint) *MetadataSchema {
+	if folderID == nil {
+		return nil
+	}
+	chain := folderAncestors(*folderID)
+	for i := len(chain) - 1; i >= 0; i-- {
+		var s MetadataSchema
+		if err := tx.Where("folder_id = ?", chain[i].ID).First(&s).Error; err == nil {
+			return &s
+		}
+	}
+	return nil
+}
+
+// patchMetadata applies a JSON merge patch to m: null removes a key, any
+// other value sets it.
+func patchMetadata(m Metadata, patch map[string]interface{}) (Metadata, error) {
+	out := Metadata{}
+	for k, v := range m {
+		out[k] = v
+	}
+	for k, v := range patch {
+		key := strings.ToLower(strings.TrimSpace(k))
+		if !metadataKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid key %q (letters, digits, _ and -, at most 64)", k)
+		}
+		if v == nil {
+			delete(out, key)
+			continue
+		}
+		if metadataType(v) == "" {
+			return nil, fmt.Errorf("%s: values must be strings, numbers or booleans", key)
+		}
+		if s, ok := v.(string); ok && len(s) > maxMetadataValue {
+			return nil, fmt.Errorf("%s: value longer than %d bytes", key, maxMetadataValue)
+		}
+		out[key] = v
+	}
+	if len(out) > maxMetadataKeys {
+		return nil, fmt.Errorf("at most %d keys", maxMetadataKeys)
+	}
+	return out, nil
+}
+
+// metadataMatchSQL matches files whose key equals the raw value from a
+// search parameter. A value that reads as a number or boolean also matches
+// that type, so meta.year=2025 finds 2025 as well as "2025".
+func metadataMatchSQL(key, raw string) (string, []interface{}) {
+	candidates := []interface{}{raw}
+	// NaN and Inf parse but have no JSON form
+	if n, err := strconv.ParseFloat(raw, 64); err == nil && !math.IsNaN(n) && !math.IsInf(n, 0) {
+		candidates = append(candidates, n)
+	}
+	if b, err := strconv.ParseBool(raw); err == nil && (raw == "true" || raw == "false") {
+		candidates = append(candidates, b)
+	}
+	conds := make([]string, 0, len(candidates))
+	args := make([]interface{}, 0, len(candidates))
+	for _, v := range candidates {
+		b, err := json.Marshal(map[string]interface{}{key: v})
+		if err != nil {
+			continue
+		}
+		conds = append(conds, "files.metadata @> ?::jsonb")
+		args = append(args, string(b))
+	}
+	return strings.Join(conds, " OR "), args
+}
+
+// metadataFilters applies the meta.<key>=<value> search parameters.
+func metadataFilters(c *gin.Context, db *gorm.DB) *gorm.DB {
+	params := c.Request.URL.Query()
+	keys := make([]string, 0)
+	for k := range params {
+		if strings.HasPrefix(k, "meta.") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		key := strings.ToLower(strings.TrimPrefix(k, "meta."))
+		if !metadataKeyPattern.MatchString(key) {
+			continue
+		}
+		for _, v := range params[k] {
+			sql, args := metadataMatchSQL(key, v)
+			db = db.Where(sql, args...)
+		}
+	}
+	return db
+}
+
+// GET /files/:id/metadata
+func GetFileMetadataHandler(c *gin.Context) {
+	_, file, ok := loadVersionedFile(c)
+	if !ok {
+		return
+	}
+	resp := gin.H{"file_id": file.ID, "metadata": file.Metadata, "schema": nil}
+	if s := folderMetadataSchema(DB, file.FolderID); s != nil {
+		missing, _ := s.check(file.Metadata)
+		resp["schema"], resp["missing"] = s, missing
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// PATCH /files/:id/metadata  { "customer": "ACME", "project": 42, "draft": null }
+//
+// Merges the body into the file's metadata (null removes a key). The result
+// must satisfy the metadata schema of the file's folder.
+func PatchFileMetadataHandler(c *gin.Context) {
+	file, ok := loadOwnedFile(c)
+	if !ok {
+		return
+	}
+	var patch map[string]interface{}
+	if err := c.BindJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must be a JSON object"})
+		return
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		// lock the row so concurrent patches do not lose each other's keys
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&file, file.ID).Error; err != nil {
+			return err
+		}
+		m, err := patchMetadata(file.Metadata, patch)
+		if err != nil {
+			return opError(http.StatusBadRequest, err.Error())
+		}
+		if s := folderMetadataSchema(tx, file.FolderID); s != nil {
+			if err := s.require(m); err != nil {
+				return err
+			}
+		}
+		file.Metadata = m
+		return tx.Model(&file).Update("metadata", m).Error
+	})
+	if err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"file_id": file.ID, "metadata": file.Metadata})
+}
+
+// GET /admin/metadata-schemas
+func AdminListMetadataSchemas(c *gin.Context) {
+	var schemas []MetadataSchema
+	DB.Order("folder_id").Find(&schemas)
+	c.JSON(http.StatusOK, gin.H{"schemas": schemas})
+}
+
+// PUT /admin/folders/:id/metadata-schema  { "fields": [{ "key": "customer", "type": "string", "required": true }] }
+//
+// Applies to files in the folder and in subfolders without a schema of
+// their own. Files moved or copied there must satisfy it; files already
+// there are not checked until their metadata changes.
+func AdminSetMetadataSchema(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder id"})
+		return
+	}
+	var body struct {
+		Fields schemaFields `json:"fields"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+		return
+	}
+	var keys []string
+	for i, f := range body.Fields {
+		f.Key = strings.ToLower(strings.TrimSpace(f.Key))
+		if !metadataKeyPattern.MatchString(f.Key) || slices.Contains(keys, f.Key) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or repeated key " + strconv.Quote(f.Key)})
+			return
+		}
+		if f.Type != "string" && f.Type != "number" && f.Type != "boolean" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": f.Key + ": type must be string, number or boolean"})
+			return
+		}
+		keys = append(keys, f.Key)
+		body.Fields[i] = f
+	}
+	var folder Folder
+	if err := DB.First(&folder, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+	admin := c.MustGet("user").(User)
+	schema := MetadataSchema{FolderID: folder.ID, Fields: body.Fields, CreatedByID: admin.ID}
+	err = DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "folder_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"fields", "created_by_id", "updated_at"}),
+	}).Create(&schema).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save schema"})
+		return
+	}
+	DB.Where("folder_id = ?", folder.ID).First(&schema)
+	c.JSON(http.StatusOK, gin.H{"schema": schema})
+}
+
+// DELETE /admin/folders/:id/metadata-schema
+func AdminDeleteMetadataSchema(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder id"})
+		return
+	}
+	res := DB.Where("folder_id = ?", id).Delete(&MetadataSchema{})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder has no schema"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
@@ -0,0 +1,13 @@
+-- per-object secrets; rotating one revokes every signed URL minted for it
+ALTER TABLE files
+  ADD COLUMN IF NOT EXISTS sign_secret varchar(64);
+
+ALTER TABLE folders
+  ADD COLUMN IF NOT EXISTS sign_secret varchar(64);
+
+-- use counters for signed URLs minted with a max-use limit
+CREATE TABLE IF NOT EXISTS signed_url_uses (
+  nonce varchar(64) PRIMARY KEY,
+  uses integer NOT NULL DEFAULT 0,
+  created_at timestamp DEFAULT now()
+);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS share_links (
+  id serial PRIMARY KEY,
+  file_id integer REFERENCES files(id) ON DELETE CASCADE,
+  folder_id integer REFERENCES folders(id) ON DELETE CASCADE,
+  token varchar(255) UNIQUE NOT NULL,
+  label varchar(255),
+  password_hash varchar(255),
+  expires_at timestamp,
+  max_downloads bigint,
+  download_count bigint DEFAULT 0,
+  created_by_id integer REFERENCES users(id) ON DELETE CASCADE,
+  created_at timestamp DEFAULT now(),
+  CHECK ((file_id IS NULL) <> (folder_id IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS idx_share_links_file ON share_links(file_id);
+CREATE INDEX IF NOT EXISTS idx_share_links_folder ON share_links(folder_id);
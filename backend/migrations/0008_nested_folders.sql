@@ -0,0 +1,26 @@
+ALTER TABLE folders
+  ADD COLUMN IF NOT EXISTS parent_id integer REFERENCES folders(id);
+
+CREATE INDEX IF NOT EXISTS idx_folders_parent ON folders(parent_id);
+
+-- Folder names used to repeat freely. Rename the duplicates to "name (n)",
+-- oldest first, before the unique index below; a pass repeats while a new
+-- name still clashes with an existing folder.
+DO $$
+BEGIN
+  LOOP
+    WITH dup AS (
+      SELECT id, row_number() OVER (
+               PARTITION BY uploader_id, COALESCE(parent_id, 0), name
+               ORDER BY created_at, id) - 1 AS n
+      FROM folders
+    )
+    UPDATE folders f SET name = f.name || ' (' || dup.n || ')'
+    FROM dup WHERE dup.id = f.id AND dup.n > 0;
+    EXIT WHEN NOT FOUND;
+  END LOOP;
+END $$;
+
+-- folder names are unique among siblings (root folders share parent 0)
+CREATE UNIQUE INDEX IF NOT EXISTS idx_folders_owner_parent_name
+  ON folders (uploader_id, COALESCE(parent_id, 0), name);
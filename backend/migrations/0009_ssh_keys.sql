@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS ssh_keys (
+  id serial PRIMARY KEY,
+  user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  label varchar(255),
+  public_key text NOT NULL,
+  fingerprint varchar(255) UNIQUE NOT NULL,
+  last_used_at timestamp,
+  created_at timestamp DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_ssh_keys_user ON ssh_keys(user_id);
@@ -0,0 +1,4 @@
+ALTER TABLE files
+  ADD COLUMN IF NOT EXISTS deleted_at timestamp;
+
+CREATE INDEX IF NOT EXISTS idx_files_deleted_at ON files(deleted_at);
@@ -0,0 +1,18 @@
+ALTER TABLE files
+  ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1,
+  ADD COLUMN IF NOT EXISTS max_versions integer;
+
+CREATE TABLE IF NOT EXISTS file_versions (
+  id serial PRIMARY KEY,
+  file_id integer NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+  version integer NOT NULL,
+  hash varchar(128),
+  path varchar(2000),
+  size bigint NOT NULL,
+  content_type varchar(255),
+  uploader_id integer REFERENCES users(id),
+  created_at timestamp DEFAULT now(),
+  UNIQUE (file_id, version)
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_versions_hash ON file_versions(hash);
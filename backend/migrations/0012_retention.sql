@@ -0,0 +1,17 @@
+ALTER TABLE files
+  ADD COLUMN IF NOT EXISTS legal_hold boolean NOT NULL DEFAULT false,
+  ADD COLUMN IF NOT EXISTS hold_reason text NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS retention_rules (
+  id serial PRIMARY KEY,
+  folder_id integer REFERENCES folders(id),
+  tag varchar(255) NOT NULL DEFAULT '',
+  min_retention_days integer NOT NULL DEFAULT 0,
+  max_age_days integer NOT NULL DEFAULT 0,
+  created_by_id integer REFERENCES users(id),
+  created_at timestamp DEFAULT now(),
+  CHECK ((folder_id IS NOT NULL) <> (tag <> ''))
+);
+
+CREATE INDEX IF NOT EXISTS idx_retention_rules_folder ON retention_rules(folder_id);
+CREATE INDEX IF NOT EXISTS idx_files_legal_hold ON files(id) WHERE legal_hold;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS blob_texts (
+  hash varchar(128) PRIMARY KEY,
+  body text NOT NULL DEFAULT '',
+  extractor varchar(32),
+  indexed_at timestamp DEFAULT now(),
+  tsv tsvector GENERATED ALWAYS AS (to_tsvector('english', body)) STORED
+);
+
+CREATE INDEX IF NOT EXISTS idx_blob_texts_tsv ON blob_texts USING GIN (tsv);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS saved_searches (
+  id serial PRIMARY KEY,
+  owner_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name varchar(255) NOT NULL,
+  params text NOT NULL DEFAULT '',
+  created_at timestamp DEFAULT now(),
+  updated_at timestamp DEFAULT now(),
+  UNIQUE (owner_id, name)
+);
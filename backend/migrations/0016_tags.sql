@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS tags (
+  id serial PRIMARY KEY,
+  owner_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name varchar(100) NOT NULL,
+  created_at timestamp DEFAULT now()
+);
+
+-- tag names are unique per user, ignoring case
+CREATE UNIQUE INDEX IF NOT EXISTS idx_tags_owner_name ON tags(owner_id, lower(name));
+
+CREATE TABLE IF NOT EXISTS file_tags (
+  file_id integer NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+  tag_id integer NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+  PRIMARY KEY (file_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_tags_tag ON file_tags(tag_id);
+
+-- Split the legacy comma-separated files.tags into the owner's tags, then
+-- empty it. 0003 keeps recreating the column, which is no longer read.
+INSERT INTO tags (owner_id, name)
+SELECT DISTINCT ON (f.uploader_id, lower(trim(raw.name))) f.uploader_id, trim(raw.name)
+FROM files f, unnest(string_to_array(f.tags, ',')) AS raw(name)
+WHERE f.tags IS NOT NULL AND f.uploader_id IS NOT NULL
+  AND trim(raw.name) <> '' AND length(trim(raw.name)) <= 100
+ON CONFLICT DO NOTHING;
+
+INSERT INTO file_tags (file_id, tag_id)
+SELECT DISTINCT f.id, t.id
+FROM files f, unnest(string_to_array(f.tags, ',')) AS raw(name)
+JOIN tags t ON lower(t.name) = lower(trim(raw.name))
+WHERE f.tags IS NOT NULL AND t.owner_id = f.uploader_id
+ON CONFLICT DO NOTHING;
+
+UPDATE files SET tags = NULL WHERE tags IS NOT NULL;
@@ -0,0 +1,13 @@
+ALTER TABLE files
+  ADD COLUMN IF NOT EXISTS metadata jsonb NOT NULL DEFAULT '{}';
+
+-- serves the metadata @> '{"key": value}' search filters
+CREATE INDEX IF NOT EXISTS idx_files_metadata ON files USING GIN (metadata jsonb_path_ops);
+
+CREATE TABLE IF NOT EXISTS metadata_schemas (
+  id serial PRIMARY KEY,
+  folder_id integer NOT NULL UNIQUE REFERENCES folders(id) ON DELETE CASCADE,
+  fields jsonb NOT NULL DEFAULT '[]',
+  created_by_id integer REFERENCES users(id),
+  updated_at timestamp DEFAULT now()
+);
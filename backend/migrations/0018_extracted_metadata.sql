@@ -0,0 +1,2 @@
+ALTER TABLE files
+  ADD COLUMN IF NOT EXISTS extracted jsonb NOT NULL DEFAULT '{}';
@@ -0,0 +1,5 @@
+-- lets the janitor drop use counters once their signed URL has expired
+ALTER TABLE signed_url_uses
+  ADD COLUMN IF NOT EXISTS expires_at timestamp;
+
+CREATE INDEX IF NOT EXISTS idx_signed_url_uses_expires_at ON signed_url_uses(expires_at);
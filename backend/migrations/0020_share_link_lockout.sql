@@ -0,0 +1,4 @@
+-- wrong passwords are counted per link; too many lock it for a while
+ALTER TABLE share_links
+  ADD COLUMN IF NOT EXISTS failed_attempts integer DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS locked_until timestamp;
@@ -1,6 +1,10 @@
 package main
 
-import "time"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type User struct {
 	ID        uint   `gorm:"primaryKey"`
@@ -13,10 +17,12 @@ type User struct {
 type Folder struct {
 	ID          uint   `gorm:"primaryKey"`
 	Name        string `gorm:"index"`
+	ParentID    *uint  `gorm:"index"`
 	UploaderID  uint
 	Uploader    User
 	Public      bool
 	PublicToken *string `gorm:"uniqueIndex;default:null"`
+	SignSecret  string  `json:"-"`
 	CreatedAt   time.Time
 }
 
@@ -35,8 +41,16 @@ type File struct {
 	PublicToken   *string `gorm:"uniqueIndex;default:null"`
 	DownloadCount int64
 	RefCount      int64
+	SignSecret    string `json:"-"`
+	Version       int    `gorm:"default:1"` // number of the current version
+	MaxVersions   *int   // overrides MAX_FILE_VERSIONS for this file
+	LegalHold     bool   // frozen: no deletion, purge or new versions
+	HoldReason    string
 	CreatedAt     time.Time
-	Tags          string
+	DeletedAt     gorm.DeletedAt `gorm:"index"` // set while the file is in the trash
+	Tags          []Tag          `gorm:"many2many:file_tags"`
+	Metadata      Metadata       `gorm:"type:jsonb"` // custom key/value fields
+	Extracted     Metadata       `gorm:"type:jsonb"` // read from the content on upload
 }
 type SharedFileAccess struct {
 	ID           uint      `gorm:"primaryKey" json:"id"`
@@ -56,3 +70,102 @@ type SharedFolderAccess struct {
 	Folder       Folder    `gorm:"foreignKey:FolderID"`
 	TargetUser   User      `gorm:"foreignKey:TargetUserID"`
 }
+
+// ShareLink is one of possibly many public links for a file or a folder.
+type ShareLink struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	FileID        *uint      `gorm:"index" json:"file_id,omitempty"`
+	FolderID      *uint      `gorm:"index" json:"folder_id,omitempty"`
+	Token         string     `gorm:"uniqueIndex" json:"token"`
+	Label         string     `json:"label"`
+	PasswordHash  string     `json:"-"`
+	HasPassword   bool       `gorm:"-" json:"has_password"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	MaxDownloads  *int64     `json:"max_downloads"`
+	DownloadCount int64      `json:"download_count"`
+	CreatedByID   uint       `json:"created_by_id"`
+	CreatedAt     time.Time  `json:"created_at"`
+
+	// wrong-password throttling
+	FailedAttempts int        `json:"-"`
+	LockedUntil    *time.Time `json:"-"`
+}
+
+// SSHKey is a public key a user can authenticate to the SFTP server with.
+type SSHKey struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	UserID      uint       `gorm:"index" json:"user_id"`
+	Label       string     `json:"label"`
+	PublicKey   string     `json:"public_key"`
+	Fingerprint string     `gorm:"uniqueIndex" json:"fingerprint"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// FileVersion is one revision of a file's content. The file row always
+// mirrors its newest version.
+type FileVersion struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	FileID      uint      `gorm:"index" json:"file_id"`
+	Version     int       `json:"version"`
+	Hash        string    `gorm:"index" json:"hash"`
+	Path        string    `json:"-"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	UploaderID  uint      `json:"uploader_id"`
+	Uploader    User      `json:"uploader"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// RetentionRule applies to the files in a folder and its subfolders, or to
+// the files carrying a tag. Files cannot be deleted before MinRetentionDays
+// and are moved to the trash after MaxAgeDays (0 disables either).
+type RetentionRule struct {
+	ID               uint      `gorm:"primaryKey" json:"id"`
+	FolderID         *uint     `gorm:"index" json:"folder_id,omitempty"`
+	Tag              string    `json:"tag,omitempty"`
+	MinRetentionDays int       `json:"min_retention_days"`
+	MaxAgeDays       int       `json:"max_age_days"`
+	CreatedByID      uint      `json:"created_by_id"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// Tag is a label in its owner's namespace, attached to files through
+// file_tags. Names are matched ignoring case.
+type Tag struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	OwnerID   uint      `gorm:"index" json:"owner_id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MetadataSchema lists the metadata keys files in a folder (and in its
+// subfolders without a schema of their own) must or may have.
+type MetadataSchema struct {
+	ID          uint         `gorm:"primaryKey" json:"id"`
+	FolderID    uint         `gorm:"uniqueIndex" json:"folder_id"`
+	Fields      schemaFields `gorm:"type:jsonb" json:"fields"`
+	CreatedByID uint         `json:"created_by_id"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+// SavedSearch is a named set of search parameters, stored as a URL query
+// string. Saved searches also show up as smart folders.
+type SavedSearch struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	OwnerID   uint      `gorm:"index" json:"owner_id"`
+	Name      string    `json:"name"`
+	Params    string    `json:"params"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// BlobText is the text extracted from a stored blob for full-text search,
+// shared by every file with that content. The tsvector is a generated column
+// maintained by PostgreSQL.
+type BlobText struct {
+	Hash      string `gorm:"primaryKey"`
+	Body      string
+	Extractor string
+	IndexedAt time.Time
+}
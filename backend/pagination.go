@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Page sizes for list endpoints. Without limit or cursor a listing returns
+// every row, as it did before paging existed; a cursor without limit pages
+// by defaultPageSize.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// sortRelevance orders search results by how well they match. The score is
+// computed per query, so its cursor holds an offset instead of a key.
+const sortRelevance = "relevance"
+
+var fileSortColumns = map[string]string{
+	"name":           "files.filename",
+	"size":           "files.size",
+	"created_at":     "files.created_at",
+	"download_count": "files.download_count",
+}
+
+var searchSortColumns = map[string]string{
+	"name":           "files.filename",
+	"size":           "files.size",
+	"created_at":     "files.created_at",
+	"download_count": "files.download_count",
+	sortRelevance:    "",
+}
+
+var folderSortColumns = map[string]string{
+	"name":       "folders.name",
+	"created_at": "folders.created_at",
+}
+
+// pageCursor marks the last row of a page. Clients get it base64-encoded
+// and it only continues a listing with the same sort and order.
+type pageCursor struct {
+	Sort   string          `json:"s"`
+	Desc   bool            `json:"d,omitempty"`
+	Value  json.RawMessage `json:"v,omitempty"`
+	ID     uint            `json:"id,omitempty"`
+	Offset int             `json:"o,omitempty"`
+}
+
+// pageRequest is a parsed limit, cursor, sort and order.
+type pageRequest struct {
+	Limit    int // 0 returns every row
+	Sort     string
+	Desc     bool
+	column   string
+	idColumn string
+	after    *pageCursor
+	afterKey interface{}
+}
+
+// parsePage reads limit, cursor, sort and order. columns maps the sort keys
+// an endpoint accepts to their column; defaultSort applies without sort.
+// Rows are always ordered by id as well, so pages never overlap.
+func parsePage(c *gin.Context, table string, columns map[string]string, defaultSort string) (pageRequest, error) {
+	p := pageRequest{Sort: defaultSort, idColumn: table + ".id"}
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return p, errors.New("invalid limit")
+		}
+		p.Limit = min(n, maxPageSize)
+	}
+	if s := c.Query("sort"); s != "" {
+		p.Sort = s
+	}
+	col, ok := columns[p.Sort]
+	if !ok {
+		return p, fmt.Errorf("cannot sort by %q", p.Sort)
+	}
+	p.column = col
+	switch c.Query("order") {
+	case "", "asc":
+	case "desc":
+		p.Desc = true
+	default:
+		return p, errors.New("order must be asc or desc")
+	}
+
+	if s := c.Query("cursor"); s != "" {
+		var cur pageCursor
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || json.Unmarshal(b, &cur) != nil {
+			return p, errors.New("invalid cursor")
+		}
+		if cur.Sort != p.Sort || cur.Desc != p.Desc {
+			return p, errors.New("cursor belongs to a different sort order")
+		}
+		if p.column != "" {
+			if p.afterKey, err = decodeSortKey(p.Sort, cur.Value); err != nil {
+				return p, errors.New("invalid cursor")
+			}
+		}
+		p.after = &cur
+		if p.Limit == 0 {
+			p.Limit = defaultPageSize
+		}
+	}
+	return p, nil
+}
+
+// decodeSortKey reads a cursor's sort value back into the column's type.
+func decodeSortKey(sort string, raw json.RawMessage) (interface{}, error) {
+	switch sort {
+	case "name":
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case "created_at":
+		var t time.Time
+		err := json.Unmarshal(raw, &t)
+		return t, err
+	default:
+		var n int64
+		err := json.Unmarshal(raw, &n)
+		return n, err
+	}
+}
+
+// apply continues q after the cursor in the requested order and fetches one
+// row more than the page holds, to tell whether another page follows. For
+// relevance the caller orders q itself.
+func (p pageRequest) apply(q *gorm.DB) *gorm.DB {
+	if p.column == "" {
+		if p.after != nil {
+			q = q.Offset(p.after.Offset)
+		}
+		return p.limit(q)
+	}
+	dir, op := "ASC", ">"
+	if p.Desc {
+		dir, op = "DESC", "<"
+	}
+	if p.after != nil {
+		q = q.Where(fmt.Sprintf("(%s, %s) %s (?, ?)", p.column, p.idColumn, op), p.afterKey, p.after.ID)
+	}
+	return p.limit(q.Order(fmt.Sprintf("%s %s, %s %s", p.column, dir, p.idColumn, dir)))
+}
+
+func (p pageRequest) limit(q *gorm.DB) *gorm.DB {
+	if p.Limit == 0 {
+		return q
+	}
+	return q.Limit(p.Limit + 1)
+}
+
+// pageOf drops the extra row fetched by apply and returns the cursor for
+// the next page, nil on the last one. key gives a row's sort value and id.
+func pageOf[T any](p pageRequest, rows []T, key func(T) (interface{}, uint)) ([]T, *string) {
+	if p.Limit == 0 || len(rows) <= p.Limit {
+		return rows, nil
+	}
+	rows = rows[:p.Limit]
+	cur := pageCursor{Sort: p.Sort, Desc: p.Desc}
+	if p.column == "" {
+		cur.Offset = p.Limit
+		if p.after != nil {
+			cur.Offset += p.after.Offset
+		}
+	} else {
+		v, id := key(rows[len(rows)-1])
+		cur.Value, _ = json.Marshal(v)
+		cur.ID = id
+	}
+	b, _ := json.Marshal(cur)
+	next := base64.RawURLEncoding.EncodeToString(b)
+	return rows, &next
+}
+
+// fileSortKey returns the sort value of a file for the given sort key.
+func fileSortKey(sort string) func(File) (interface{}, uint) {
+	return func(f File) (interface{}, uint) {
+		switch sort {
+		case "name":
+			return f.Filename, f.ID
+		case "size":
+			return f.Size, f.ID
+		case "download_count":
+			return f.DownloadCount, f.ID
+		}
+		return f.CreatedAt, f.ID
+	}
+}
+
+func folderSortKey(sort string) func(Folder) (interface{}, uint) {
+	return func(f Folder) (interface{}, uint) {
+		if sort == "name" {
+			return f.Name, f.ID
+		}
+		return f.CreatedAt, f.ID
+	}
+}
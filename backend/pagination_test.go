@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// queryContext returns a context for a GET request with the given query.
+func queryContext(query url.Values) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/files?"+query.Encode(), nil)
+	return c
+}
+
+func TestParsePage(t *testing.T) {
+	tests := []struct {
+		query   string
+		limit   int
+		sort    string
+		desc    bool
+		wantErr string
+	}{
+		{query: "", limit: 0, sort: "created_at"},
+		{query: "limit=10", limit: 10, sort: "created_at"},
+		{query: "limit=5000", limit: maxPageSize, sort: "created_at"},
+		{query: "sort=name&order=desc", limit: 0, sort: "name", desc: true},
+		{query: "limit=0", wantErr: "invalid limit"},
+		{query: "limit=ten", wantErr: "invalid limit"},
+		{query: "sort=owner", wantErr: `cannot sort by "owner"`},
+		{query: "order=up", wantErr: "order must be asc or desc"},
+		{query: "cursor=!!", wantErr: "invalid cursor"},
+	}
+	for _, tt := range tests {
+		vals, _ := url.ParseQuery(tt.query)
+		p, err := parsePage(queryContext(vals), "files", fileSortColumns, "created_at")
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("parsePage(%q) error = %v, want %q", tt.query, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePage(%q): %v", tt.query, err)
+			continue
+		}
+		if p.Limit != tt.limit || p.Sort != tt.sort || p.Desc != tt.desc {
+			t.Errorf("parsePage(%q) = limit %d sort %s desc %v, want %d %s %v",
+				tt.query, p.Limit, p.Sort, p.Desc, tt.limit, tt.sort, tt.desc)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	created := time.Date(2025, 3, 14, 15, 9, 26, 535000000, time.UTC)
+	files := []File{
+		{ID: 4, Filename: "a.txt", Size: 10, DownloadCount: 3, CreatedAt: created.Add(-time.Hour)},
+		{ID: 9, Filename: "b.txt", Size: 20, DownloadCount: 7, CreatedAt: created},
+		{ID: 2, Filename: "c.txt", Size: 30, DownloadCount: 1, CreatedAt: created.Add(time.Hour)},
+	}
+	tests := []struct {
+		sort, order string
+		wantKey     interface{}
+	}{
+		{"name", "", "b.txt"},
+		{"size", "desc", int64(20)},
+		{"download_count", "", int64(7)},
+		{"created_at", "desc", created},
+	}
+	for _, tt := range tests {
+		vals := url.Values{"limit": {"2"}, "sort": {tt.sort}}
+		if tt.order != "" {
+			vals.Set("order", tt.order)
+		}
+		p, err := parsePage(queryContext(vals), "files", fileSortColumns, "created_at")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.sort, err)
+		}
+		page, next := pageOf(p, files, fileSortKey(p.Sort))
+		if len(page) != 2 || next == nil {
+			t.Fatalf("%s: got %d rows and cursor %v, want 2 rows and a cursor", tt.sort, len(page), next)
+		}
+
+		vals.Set("cursor", *next)
+		p, err = parsePage(queryContext(vals), "files", fileSortColumns, "created_at")
+		if err != nil {
+			t.Fatalf("%s: cursor rejected: %v", tt.sort, err)
+		}
+		if p.after == nil || p.after.ID != 9 {
+			t.Fatalf("%s: cursor continues after %+v, want file 9", tt.sort, p.after)
+		}
+		if got, ok := p.afterKey.(time.Time); ok {
+			if !got.Equal(tt.wantKey.(time.Time)) {
+				t.Errorf("%s: cursor key %v, want %v", tt.sort, got, tt.wantKey)
+			}
+		} else if p.afterKey != tt.wantKey {
+			t.Errorf("%s: cursor key %#v, want %#v", tt.sort, p.afterKey, tt.wantKey)
+		}
+
+		// a cursor only continues the order it was made for
+		vals.Set("order", map[string]string{"": "desc", "desc": "asc"}[tt.order])
+		if _, err := parsePage(queryContext(vals), "files", fileSortColumns, "created_at"); err == nil {
+			t.Errorf("%s: cursor accepted for the opposite order", tt.sort)
+		}
+	}
+}
+
+func TestPageOf(t *testing.T) {
+	rows := []File{{ID: 1}, {ID: 2}, {ID: 3}}
+	key := fileSortKey("created_at")
+
+	if page, next := pageOf(pageRequest{}, rows, key); len(page) != 3 || next != nil {
+		t.Errorf("without limit: %d rows, cursor %v; want every row and no cursor", len(page), next)
+	}
+	if page, next := pageOf(pageRequest{Limit: 3}, rows, key); len(page) != 3 || next != nil {
+		t.Errorf("last page: %d rows, cursor %v; want 3 rows and no cursor", len(page), next)
+	}
+
+	// relevance pages by offset, adding up across pages
+	p := pageRequest{Limit: 2, Sort: sortRelevance, after: &pageCursor{Sort: sortRelevance, Offset: 4}}
+	_, next := pageOf(p, rows, key)
+	if next == nil {
+		t.Fatal("relevance: no cursor")
+	}
+	c := queryContext(url.Values{"sort": {sortRelevance}, "cursor": {*next}})
+	p, err := parsePage(c, "files", searchSortColumns, "created_at")
+	if err != nil {
+		t.Fatalf("relevance cursor rejected: %v", err)
+	}
+	if p.after.Offset != 6 || p.Limit != defaultPageSize {
+		t.Errorf("relevance cursor: offset %d limit %d, want 6 and %d", p.after.Offset, p.Limit, defaultPageSize)
+	}
+}
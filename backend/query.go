@@ -0,0 +1,559 @@
+package main
+
+// The search query language, for example
+//
+//	type:pdf size:>5MB tag:invoice -tag:draft uploaded:2025-01..2025-03 "annual report"
+//
+// Terms are ANDed unless joined by OR, and NOT or a leading - negates a term
+// or a parenthesised group. Bare words and quoted phrases match filenames.
+// A query is parsed into an AST that is compiled to SQL in which every value
+// is a bound parameter.
+
+import (
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Limits that keep a single query cheap to parse and to run.
+const (
+	maxQueryTerms = 64
+	maxQueryDepth = 16
+)
+
+// tagMatchSQL matches files carrying the tag named ? (lowercase).
+const tagMatchSQL = `EXISTS (SELECT 1 FROM file_tags ft JOIN tags t ON t.id = ft.tag_id
+	WHERE ft.file_id = files.id AND lower(t.name) = ?)`
+
+const queryFields = "name, type, size, tag, uploaded, uploader, is, content, meta.<key>, " +
+	"width, height, pages, taken, camera, title, author"
+
+// queryError is a query that could not be parsed, with the 1-based
+// position of the offending character.
+type queryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("query error at position %d: %s", e.Pos, e.Msg)
+}
+
+func queryErrorf(pos int, format string, args ...interface{}) error {
+	return &queryError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+type tokenKind int
+
+const (
+	tokWord   tokenKind = iota // bare word or field:value
+	tokPhrase                  // "quoted words"
+	tokLParen
+	tokRParen
+	tokAnd
+	tokOr
+	tokNot
+	tokEOF
+)
+
+type queryToken struct {
+	kind  tokenKind
+	field string
+	value string
+	pos   int
+}
+
+func lexQuery(s string) ([]queryToken, error) {
+	rs := []rune(s)
+	var toks []queryToken
+	for i := 0; i < len(rs); {
+		r, pos := rs[i], i+1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			toks = append(toks, queryToken{kind: tokLParen, pos: pos})
+			i++
+		case r == ')':
+			toks = append(toks, queryToken{kind: tokRParen, pos: pos})
+			i++
+		case r == '-' && i+1 < len(rs) && !unicode.IsSpace(rs[i+1]) && rs[i+1] != ')':
+			toks = append(toks, queryToken{kind: tokNot, pos: pos})
+			i++
+		case r == '"':
+			v, next, err := readQuoted(rs, i)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, queryToken{kind: tokPhrase, value: v, pos: pos})
+			i = next
+		default:
+			start := i
+			for i < len(rs) && !unicode.IsSpace(rs[i]) && !strings.ContainsRune(`()"`, rs[i]) {
+				i++
+			}
+			word := string(rs[start:i])
+			tok := queryToken{kind: tokWord, value: word, pos: pos}
+			if k := strings.IndexByte(word, ':'); k > 0 {
+				tok.field, tok.value = strings.ToLower(word[:k]), word[k+1:]
+				if tok.value == "" && i < len(rs) && rs[i] == '"' {
+					v, next, err := readQuoted(rs, i)
+					if err != nil {
+						return nil, err
+					}
+					tok.value, i = v, next
+				}
+				if tok.value == "" {
+					return nil, queryErrorf(pos, "%s: needs a value", tok.field)
+				}
+			} else {
+				switch word {
+				case "AND":
+					tok.kind = tokAnd
+				case "OR":
+					tok.kind = tokOr
+				case "NOT":
+					tok.kind = tokNot
+				}
+			}
+			toks = append(toks, tok)
+		}
+	}
+	return append(toks, queryToken{kind: tokEOF, pos: len(rs) + 1}), nil
+}
+
+// readQuoted reads the quoted string starting at rs[i], where \" and \\
+// stand for themselves, and returns it with the index after the quote.
+func readQuoted(rs []rune, i int) (string, int, error) {
+	var sb strings.Builder
+	for j := i + 1; j < len(rs); j++ {
+		switch {
+		case rs[j] == '\\' && j+1 < len(rs) && (rs[j+1] == '"' || rs[j+1] == '\\'):
+			j++
+			sb.WriteRune(rs[j])
+		case rs[j] == '"':
+			return sb.String(), j + 1, nil
+		default:
+			sb.WriteRune(rs[j])
+		}
+	}
+	return "", 0, queryErrorf(i+1, "missing closing quote")
+}
+
+// queryNode is a node of the parsed query; build appends its SQL.
+type queryNode interface {
+	build(sb *strings.Builder, args *[]interface{})
+}
+
+type andNode struct{ left, right queryNode }
+type orNode struct{ left, right queryNode }
+type notNode struct{ inner queryNode }
+
+// termNode is one compiled condition, such as files.size > ?.
+type termNode struct {
+	sql  string
+	args []interface{}
+}
+
+func (n andNode) build(sb *strings.Builder, args *[]interface{}) {
+	sb.WriteByte('(')
+	n.left.build(sb, args)
+	sb.WriteString(" AND ")
+	n.right.build(sb, args)
+	sb.WriteByte(')')
+}
+
+func (n orNode) build(sb *strings.Builder, args *[]interface{}) {
+	sb.WriteByte('(')
+	n.left.build(sb, args)
+	sb.WriteString(" OR ")
+	n.right.build(sb, args)
+	sb.WriteByte(')')
+}
+
+func (n notNode) build(sb *strings.Builder, args *[]interface{}) {
+	sb.WriteString("NOT ")
+	n.inner.build(sb, args)
+}
+
+func (n termNode) build(sb *strings.Builder, args *[]interface{}) {
+	sb.WriteByte('(')
+	sb.WriteString(n.sql)
+	sb.WriteByte(')')
+	*args = append(*args, n.args...)
+}
+
+// compiledQuery is a WHERE condition on files with its parameters.
+type compiledQuery struct {
+	SQL  string
+	Args []interface{}
+}
+
+// parseSearchQuery parses a query and compiles it to a condition on files,
+// as seen by the user with id userID.
+func parseSearchQuery(s string, userID uint) (compiledQuery, error) {
+	toks, err := lexQuery(s)
+	if err != nil {
+		return compiledQuery{}, err
+	}
+	p := &queryParser{toks: toks, userID: userID}
+	if p.peek().kind == tokEOF {
+		return compiledQuery{}, queryErrorf(1, "empty query")
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return compiledQuery{}, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return compiledQuery{}, queryErrorf(t.pos, "unexpected \")\"")
+	}
+	var sb strings.Builder
+	var args []interface{}
+	root.build(&sb, &args)
+	return compiledQuery{SQL: sb.String(), Args: args}, nil
+}
+
+// queryParser is a recursive descent parser over
+//
+//	or    = and { "OR" and }
+//	and   = unary { ["AND"] unary }
+//	unary = ("NOT" | "-") unary | "(" or ")" | term
+type queryParser struct {
+	toks   []queryToken
+	i      int
+	depth  int
+	terms  int
+	userID uint // the caller, for terms that only see their own files
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.toks[p.i]
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.i++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case tokAnd:
+			p.i++
+		case tokWord, tokPhrase, tokLParen, tokNot:
+		default:
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNot:
+		if p.depth++; p.depth > maxQueryDepth {
+			return nil, queryErrorf(t.pos, "too deeply nested (at most %d levels)", maxQueryDepth)
+		}
+		p.i++
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		p.depth--
+		return notNode{inner}, nil
+	case tokLParen:
+		if p.depth++; p.depth > maxQueryDepth {
+			return nil, queryErrorf(t.pos, "too deeply nested (at most %d levels)", maxQueryDepth)
+		}
+		p.i++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.peek(); closing.kind != tokRParen {
+			return nil, queryErrorf(closing.pos, "expected \")\" to close \"(\" at position %d", t.pos)
+		}
+		p.i++
+		p.depth--
+		return inner, nil
+	case tokWord, tokPhrase:
+		if p.terms++; p.terms > maxQueryTerms {
+			return nil, queryErrorf(t.pos, "too many terms (at most %d)", maxQueryTerms)
+		}
+		p.i++
+		return compileTerm(t, p.userID)
+	case tokRParen:
+		return nil, queryErrorf(t.pos, "unexpected \")\"")
+	case tokAnd, tokOr:
+		return nil, queryErrorf(t.pos, "%s needs a term before it", map[tokenKind]string{tokAnd: "AND", tokOr: "OR"}[t.kind])
+	}
+	return nil, queryErrorf(t.pos, "query ends where a term was expected")
+}
+
+// likePattern escapes LIKE wildcards in s and turns * into one.
+func likePattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+	return strings.ReplaceAll(s, "*", "%")
+}
+
+// mimeGroups are type: values that stand for a whole family of types.
+var mimeGroups = map[string]string{
+	"image": "image/%",
+	"video": "video/%",
+	"audio": "audio/%",
+	"text":  "text/%",
+}
+
+func compileTerm(t queryToken, userID uint) (queryNode, error) {
+	v := t.value
+	switch t.field {
+	case "", "name":
+		return termNode{"files.filename ILIKE ?", []interface{}{"%" + likePattern(v) + "%"}}, nil
+
+	case "type":
+		v = strings.ToLower(v)
+		if strings.Contains(v, "/") {
+			return termNode{"COALESCE(files.content_type, '') ILIKE ?", []interface{}{likePattern(v)}}, nil
+		}
+		if group, ok := mimeGroups[v]; ok {
+			return termNode{"COALESCE(files.content_type, '') LIKE ?", []interface{}{group}}, nil
+		}
+		// a file extension: the type it stands for, or the extension itself
+		ext := "%." + likePattern(strings.TrimPrefix(v, "."))
+		if ct := baseMime(mime.TypeByExtension("." + strings.TrimPrefix(v, "."))); ct != "" {
+			return termNode{"COALESCE(files.content_type, '') = ? OR files.filename ILIKE ?", []interface{}{ct, ext}}, nil
+		}
+		return termNode{"files.filename ILIKE ?", []interface{}{ext}}, nil
+
+	case "size":
+		return compileRange(t, "files.size", func(s string) (interface{}, interface{}, error) {
+			n, err := parseSize(s)
+			return n, n + 1, err
+		})
+
+	case "uploaded", "created":
+		return compileRange(t, "files.created_at", func(s string) (interface{}, interface{}, error) {
+			start, end, err := parsePeriod(s)
+			return start, end, err
+		})
+
+	case "tag":
+		return termNode{tagMatchSQL, []interface{}{strings.ToLower(v)}}, nil
+
+	case "uploader", "owner":
+		return termNode{"files.uploader_id IN (SELECT id FROM users WHERE username ILIKE ?)", []interface{}{likePattern(v)}}, nil
+
+	case "is":
+		switch strings.ToLower(v) {
+		case "public":
+			return termNode{"files.public", nil}, nil
+		case "shared":
+			return termNode{"EXISTS (SELECT 1 FROM shared_file_access s WHERE s.file_id = files.id)", nil}, nil
+		case "geotagged":
+			// only the uploader sees GPS positions, so only their files can match
+			return termNode{"files.uploader_id = ? AND files.extracted ->> 'gps_latitude' IS NOT NULL", []interface{}{userID}}, nil
+		}
+		return nil, queryErrorf(t.pos, "is: takes public, shared or geotagged, not %q", v)
+
+	// metadata read from images and PDFs on upload
+	case "width", "height", "pages":
+		return compileRange(t, "(files.extracted ->> '"+t.field+"')::numeric", func(s string) (interface{}, interface{}, error) {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil, fmt.Errorf("invalid number %q", s)
+			}
+			return n, n + 1, nil
+		})
+
+	case "taken":
+		return compileRange(t, "(files.extracted ->> 'taken_at')::timestamp", func(s string) (interface{}, interface{}, error) {
+			start, end, err := parsePeriod(s)
+			return start, end, err
+		})
+
+	case "camera":
+		return termNode{
+			"concat_ws(' ', files.extracted ->> 'camera_make', files.extracted ->> 'camera_model') ILIKE ?",
+			[]interface{}{"%" + likePattern(v) + "%"},
+		}, nil
+
+	case "title", "author":
+		return termNode{"files.extracted ->> '" + t.field + "' ILIKE ?", []interface{}{"%" + likePattern(v) + "%"}}, nil
+
+	case "content", "text":
+		return termNode{
+			"EXISTS (SELECT 1 FROM blob_texts qt WHERE qt.hash = files.hash AND qt.tsv @@ websearch_to_tsquery('english', ?))",
+			[]interface{}{v},
+		}, nil
+	}
+	if key, ok := strings.CutPrefix(t.field, "meta."); ok {
+		if !metadataKeyPattern.MatchString(key) {
+			return nil, queryErrorf(t.pos, "invalid metadata key %q", key)
+		}
+		if v == "*" {
+			return termNode{"files.metadata ->> ? IS NOT NULL", []interface{}{key}}, nil
+		}
+		sql, args := metadataMatchSQL(key, v)
+		return termNode{sql, args}, nil
+	}
+	return nil, queryErrorf(t.pos, "unknown field %q (fields: %s)", t.field, queryFields)
+}
+
+// compileRange compiles a comparison (>5MB, <=2025-01), a range (a..b, with
+// either end open) or a single value on column. bounds parses one value
+// into the first value it covers and the first one past it.
+func compileRange(t queryToken, column string, bounds func(string) (interface{}, interface{}, error)) (queryNode, error) {
+	v := t.value
+	parse := func(s string) (interface{}, interface{}, error) {
+		lo, hi, err := bounds(s)
+		if err != nil {
+			return nil, nil, queryErrorf(t.pos, "%v", err)
+		}
+		return lo, hi, nil
+	}
+
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if !strings.HasPrefix(v, op) {
+			continue
+		}
+		lo, hi, err := parse(v[len(op):])
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case ">=":
+			return termNode{column + " >= ?", []interface{}{lo}}, nil
+		case "<=":
+			return termNode{column + " < ?", []interface{}{hi}}, nil
+		case ">":
+			return termNode{column + " >= ?", []interface{}{hi}}, nil
+		case "<":
+			return termNode{column + " < ?", []interface{}{lo}}, nil
+		}
+		return termNode{column + " >= ? AND " + column + " < ?", []interface{}{lo, hi}}, nil
+	}
+
+	if from, to, ok := strings.Cut(v, ".."); ok {
+		if from == "" && to == "" {
+			return nil, queryErrorf(t.pos, "%s: a range needs at least one end", t.field)
+		}
+		var conds []string
+		var args []interface{}
+		if from != "" {
+			lo, _, err := parse(from)
+			if err != nil {
+				return nil, err
+			}
+			conds, args = append(conds, column+" >= ?"), append(args, lo)
+		}
+		if to != "" {
+			_, hi, err := parse(to)
+			if err != nil {
+				return nil, err
+			}
+			conds, args = append(conds, column+" < ?"), append(args, hi)
+		}
+		return termNode{strings.Join(conds, " AND "), args}, nil
+	}
+
+	lo, hi, err := parse(v)
+	if err != nil {
+		return nil, err
+	}
+	return termNode{column + " >= ? AND " + column + " < ?", []interface{}{lo, hi}}, nil
+}
+
+var sizeUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kb": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30,
+	"t": 1 << 40, "tb": 1 << 40,
+}
+
+// parseSize reads sizes like 500, 1.5MB or 2g (binary units).
+func parseSize(s string) (int64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	unit, ok := sizeUnits[strings.ToLower(s[i:])]
+	if err != nil || !ok || n < 0 {
+		return 0, fmt.Errorf("invalid size %q (use e.g. 500KB, 1.5MB, 2GB)", s)
+	}
+	return int64(n * unit), nil
+}
+
+// parsePeriod reads a year, month or day and returns when it starts and
+// when the next one does. Days can also be given relative to today, as
+// today, yesterday or -7d, -2w, -3m (days, weeks or months ago), so that a
+// saved search keeps meaning "last week".
+func parsePeriod(s string) (time.Time, time.Time, error) {
+	for _, f := range []struct {
+		layout     string
+		y, m, days int
+	}{
+		{"2006-01-02", 0, 0, 1},
+		{"2006-01", 0, 1, 0},
+		{"2006", 1, 0, 0},
+	} {
+		if t, err := time.Parse(f.layout, s); err == nil {
+			return t, t.AddDate(f.y, f.m, f.days), nil
+		}
+	}
+	if day, ok := relativeDay(strings.ToLower(s)); ok {
+		return day, day.AddDate(0, 0, 1), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid date %q (use YYYY, YYYY-MM, YYYY-MM-DD, today or -7d)", s)
+}
+
+func relativeDay(s string) (time.Time, bool) {
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch s {
+	case "today":
+		return today, true
+	case "yesterday":
+		return today.AddDate(0, 0, -1), true
+	}
+	if len(s) < 3 || s[0] != '-' {
+		return time.Time{}, false
+	}
+	n, err := strconv.Atoi(s[1 : len(s)-1])
+	if err != nil || n < 0 {
+		return time.Time{}, false
+	}
+	switch s[len(s)-1] {
+	case 'd':
+		return today.AddDate(0, 0, -n), true
+	case 'w':
+		return today.AddDate(0, 0, -7*n), true
+	case 'm':
+		return today.AddDate(0, -n, 0), true
+	}
+	return time.Time{}, false
+}
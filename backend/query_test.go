@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	tests := []struct {
+		query string
+		sql   string
+		args  []interface{}
+	}{
+		{
+			query: "report",
+			sql:   "(files.filename ILIKE ?)",
+			args:  []interface{}{"%report%"},
+		},
+		{
+			query: `"annual report" 100%_done`,
+			sql:   "((files.filename ILIKE ?) AND (files.filename ILIKE ?))",
+			args:  []interface{}{"%annual report%", `%100\%\_done%`},
+		},
+		{
+			query: "name:draft*.txt",
+			sql:   "(files.filename ILIKE ?)",
+			args:  []interface{}{"%draft%.txt%"},
+		},
+		{
+			query: "a b OR c",
+			sql:   "(((files.filename ILIKE ?) AND (files.filename ILIKE ?)) OR (files.filename ILIKE ?))",
+			args:  []interface{}{"%a%", "%b%", "%c%"},
+		},
+		{
+			query: "a AND (b OR c)",
+			sql:   "((files.filename ILIKE ?) AND ((files.filename ILIKE ?) OR (files.filename ILIKE ?)))",
+			args:  []interface{}{"%a%", "%b%", "%c%"},
+		},
+		{
+			query: "-tag:Draft NOT is:public",
+			sql:   "(NOT (" + tagMatchSQL + ") AND NOT (files.public))",
+			args:  []interface{}{"draft"},
+		},
+		{
+			query: "type:image/*",
+			sql:   "(COALESCE(files.content_type, '') ILIKE ?)",
+			args:  []interface{}{"image/%"},
+		},
+		{
+			query: "type:image",
+			sql:   "(COALESCE(files.content_type, '') LIKE ?)",
+			args:  []interface{}{"image/%"},
+		},
+		{
+			query: "type:pdf",
+			sql:   "(COALESCE(files.content_type, '') = ? OR files.filename ILIKE ?)",
+			args:  []interface{}{"application/pdf", "%.pdf"},
+		},
+		{
+			query: "size:>5MB",
+			sql:   "(files.size >= ?)",
+			args:  []interface{}{int64(5<<20 + 1)},
+		},
+		{
+			query: "size:<=1k",
+			sql:   "(files.size < ?)",
+			args:  []interface{}{int64(1025)},
+		},
+		{
+			query: "size:1.5mb..",
+			sql:   "(files.size >= ?)",
+			args:  []interface{}{int64(1.5 * (1 << 20))},
+		},
+		{
+			query: "uploaded:2025-01..2025-03",
+			sql:   "(files.created_at >= ? AND files.created_at < ?)",
+			args:  []interface{}{day("2025-01-01"), day("2025-04-01")},
+		},
+		{
+			query: "created:2024",
+			sql:   "(files.created_at >= ? AND files.created_at < ?)",
+			args:  []interface{}{day("2024-01-01"), day("2025-01-01")},
+		},
+		{
+			query: "pages:10..20",
+			sql:   "((files.extracted ->> 'pages')::numeric >= ? AND (files.extracted ->> 'pages')::numeric < ?)",
+			args:  []interface{}{int64(10), int64(21)},
+		},
+		{
+			query: "meta.customer:*",
+			sql:   "(files.metadata ->> ? IS NOT NULL)",
+			args:  []interface{}{"customer"},
+		},
+		{
+			query: `meta.customer:"ACME Inc"`,
+			sql:   "(files.metadata @> ?::jsonb)",
+			args:  []interface{}{`{"customer":"ACME Inc"}`},
+		},
+		{
+			query: "meta.score:NaN OR meta.score:-inf",
+			sql:   "((files.metadata @> ?::jsonb) OR (files.metadata @> ?::jsonb))",
+			args:  []interface{}{`{"score":"NaN"}`, `{"score":"-inf"}`},
+		},
+		{
+			query: "is:geotagged",
+			sql:   "(files.uploader_id = ? AND files.extracted ->> 'gps_latitude' IS NOT NULL)",
+			args:  []interface{}{uint(7)},
+		},
+		{
+			query: "uploader:ali*",
+			sql:   "(files.uploader_id IN (SELECT id FROM users WHERE username ILIKE ?))",
+			args:  []interface{}{"ali%"},
+		},
+	}
+	for _, tt := range tests {
+		q, err := parseSearchQuery(tt.query, 7)
+		if err != nil {
+			t.Errorf("parseSearchQuery(%q): %v", tt.query, err)
+			continue
+		}
+		if q.SQL != tt.sql {
+			t.Errorf("parseSearchQuery(%q) SQL:\n got %s\nwant %s", tt.query, q.SQL, tt.sql)
+		}
+		if fmt.Sprint(q.Args) != fmt.Sprint(tt.args) {
+			t.Errorf("parseSearchQuery(%q) args = %v, want %v", tt.query, q.Args, tt.args)
+		}
+		if strings.Count(q.SQL, "?") != len(q.Args) {
+			t.Errorf("parseSearchQuery(%q): %d placeholders for %d args", tt.query, strings.Count(q.SQL, "?"), len(q.Args))
+		}
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+		msg   string
+	}{
+		{"", 1, "empty query"},
+		{"   ", 1, "empty query"},
+		{`name:"unclosed`, 6, "missing closing quote"},
+		{`a "b`, 3, "missing closing quote"},
+		{"(a b", 5, `expected ")" to close "(" at position 1`},
+		{"a)", 2, `unexpected ")"`},
+		{"()", 2, `unexpected ")"`},
+		{"OR a", 1, "OR needs a term before it"},
+		{"a AND", 6, "query ends where a term was expected"},
+		{"a OR OR b", 6, "OR needs a term before it"},
+		{"NOT", 4, "query ends where a term was expected"},
+		{"size:", 1, "size: needs a value"},
+		{"a colour:red", 3, `unknown field "colour"`},
+		{"size:lots", 1, `invalid size "lots"`},
+		{"size:5XB", 1, `invalid size "5XB"`},
+		{"uploaded:2025-13", 1, `invalid date "2025-13"`},
+		{"size:..", 1, "size: a range needs at least one end"},
+		{"width:-1", 1, `invalid number "-1"`},
+		{"is:hidden", 1, `is: takes public, shared or geotagged, not "hidden"`},
+		{"meta.Bad$Key:x", 1, `invalid metadata key "bad$key"`},
+		{strings.Repeat("(", maxQueryDepth+1) + "a", maxQueryDepth + 1, "too deeply nested"},
+		{strings.Repeat("-", maxQueryDepth+1) + "a", maxQueryDepth + 1, "too deeply nested"},
+		{strings.Repeat("a ", maxQueryTerms) + "b", 2*maxQueryTerms + 1, "too many terms"},
+	}
+	for _, tt := range tests {
+		_, err := parseSearchQuery(tt.query, 7)
+		qerr, ok := err.(*queryError)
+		if !ok {
+			t.Errorf("parseSearchQuery(%q) error = %v, want a queryError", tt.query, err)
+			continue
+		}
+		if qerr.Pos != tt.pos || !strings.HasPrefix(qerr.Msg, tt.msg) {
+			t.Errorf("parseSearchQuery(%q) = position %d %q, want position %d %q", tt.query, qerr.Pos, qerr.Msg, tt.pos, tt.msg)
+		}
+	}
+}
+
+func TestLexQueryPositions(t *testing.T) {
+	toks, err := lexQuery(`é -"x y" tag:"a b" (OR)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []queryToken{
+		{kind: tokWord, value: "é", pos: 1},
+		{kind: tokNot, pos: 3},
+		{kind: tokPhrase, value: "x y", pos: 4},
+		{kind: tokWord, field: "tag", value: "a b", pos: 10},
+		{kind: tokLParen, pos: 20},
+		{kind: tokOr, value: "OR", pos: 21},
+		{kind: tokRParen, pos: 23},
+		{kind: tokEOF, pos: 24},
+	}
+	if len(toks) != len(want) {
+		t.Fatalf("got %d tokens %+v, want %d", len(toks), toks, len(want))
+	}
+	for i := range want {
+		if toks[i] != want[i] {
+			t.Errorf("token %d = %+v, want %+v", i, toks[i], want[i])
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"500", 500, true},
+		{"500b", 500, true},
+		{"2K", 2048, true},
+		{"1.5MB", 1572864, true},
+		{"1gb", 1 << 30, true},
+		{"", 0, false},
+		{"MB", 0, false},
+		{"1.2.3", 0, false},
+		{"5 MB", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in         string
+		start, end time.Time
+	}{
+		{"2025-02-28", time.Date(2025, 2, 28, 0, 0, 0, 0, time.UTC), time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"2025-12", time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"today", today, today.AddDate(0, 0, 1)},
+		{"Yesterday", today.AddDate(0, 0, -1), today},
+		{"-7d", today.AddDate(0, 0, -7), today.AddDate(0, 0, -6)},
+		{"-2w", today.AddDate(0, 0, -14), today.AddDate(0, 0, -13)},
+		{"-3m", today.AddDate(0, -3, 0), today.AddDate(0, -3, 1)},
+	}
+	for _, tt := range tests {
+		start, end, err := parsePeriod(tt.in)
+		if err != nil || !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("parsePeriod(%q) = %v, %v, %v; want %v, %v", tt.in, start, end, err, tt.start, tt.end)
+		}
+	}
+	for _, in := range []string{"", "2025-1", "25-01-01", "-7y", "--1d", "-d", "tomorrow"} {
+		if _, _, err := parsePeriod(in); err == nil {
+			t.Errorf("parsePeriod(%q) accepted", in)
+		}
+	}
+}
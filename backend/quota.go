@@ -1,11 +1,28 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// storageUsed returns the bytes counted against the user's quota: every
+// file they own, trashed ones included, plus the older versions kept of
+// them. The history row of the current version is the file itself, so it
+// is not counted twice.
+func storageUsed(userID uint) int64 {
+	var current, history int64
+	DB.Unscoped().Model(&File{}).Where("uploader_id = ?", userID).Select("COALESCE(SUM(size),0)").Scan(&current)
+	DB.Model(&FileVersion{}).
+		Joins("JOIN files ON files.id = file_versions.file_id").
+		Where("files.uploader_id = ? AND file_versions.version <> files.version", userID).
+		Select("COALESCE(SUM(file_versions.size),0)").Scan(&history)
+	return current + history
+}
+
 // QuotaMiddlewareForUpload checks that sum of sizes of uploaded files won't exceed quota.
 func QuotaMiddlewareForUpload() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -26,8 +43,7 @@ func QuotaMiddlewareForUpload() gin.HandlerFunc {
 		}
 
 		// Get sum of existing sizes uploaded by user (original usage)
-		var current int64
-		DB.Model(&File{}).Where("uploader_id = ?", user.ID).Select("COALESCE(SUM(size),0)").Scan(&current)
+		current := storageUsed(user.ID)
 
 		if err := c.Request.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
 			c.Next()
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// fileTagSet returns the names of the file's tags, lowercased.
+func fileTagSet(file File) map[string]bool {
+	set := map[string]bool{}
+	for _, t := range fileTagNames(DB, file.ID) {
+		set[t] = true
+	}
+	return set
+}
+
+// retentionRules holds every rule so that checking many files (a recursive
+// folder delete, the expiry job) loads them once.
+type retentionRules struct {
+	rules  []RetentionRule
+	chains map[uint][]uint // folder id -> its id and its ancestors' ids
+}
+
+func loadRetentionRules() *retentionRules {
+	r := &retentionRules{chains: map[uint][]uint{}}
+	DB.Order("id").Find(&r.rules)
+	return r
+}
+
+// chain returns the ids of the folder and its ancestors; none for the root.
+func (r *retentionRules) chain(folderID *uint) []uint {
+	if folderID == nil {
+		return nil
+	}
+	chain, ok := r.chains[*folderID]
+	if !ok {
+		for _, f := range folderAncestors(*folderID) {
+			chain = append(chain, f.ID)
+		}
+		r.chains[*folderID] = chain
+	}
+	return chain
+}
+
+// forFile returns the rules that apply to the file.
+func (r *retentionRules) forFile(file File) []RetentionRule {
+	if len(r.rules) == 0 {
+		return nil
+	}
+	chain := r.chain(file.FolderID)
+	var tags map[string]bool // loaded for the first tag rule
+	var out []RetentionRule
+	for _, rule := range r.rules {
+		if rule.Tag != "" && tags == nil {
+			tags = fileTagSet(file)
+		}
+		if rule.FolderID != nil && slices.Contains(chain, *rule.FolderID) ||
+			rule.Tag != "" && tags[strings.ToLower(rule.Tag)] {
+			out = append(out, rule)
+		}
+	}
+	return out
+}
+
+// retentionStatus is the combined effect of the rules on one file: the
+// longest minimum retention and the shortest maximum age win. A file never
+// expires before its minimum retention is over.
+type retentionStatus struct {
+	LegalHold   bool            `json:"legal_hold"`
+	HoldReason  string          `json:"hold_reason,omitempty"`
+	RetainUntil *time.Time      `json:"retain_until"`
+	ExpiresAt   *time.Time      `json:"expires_at"`
+	Rules       []RetentionRule `json:"rules"`
+}
+
+func (r *retentionRules) status(file File) retentionStatus {
+	return statusUnder(file, r.forFile(file))
+}
+
+// statusUnder combines the given rules for the file.
+func statusUnder(file File, rules []RetentionRule) retentionStatus {
+	s := retentionStatus{LegalHold: file.LegalHold, HoldReason: file.HoldReason, Rules: rules}
+	minDays, maxDays := 0, 0
+	for _, rule := range s.Rules {
+		minDays = max(minDays, rule.MinRetentionDays)
+		if rule.MaxAgeDays > 0 && (maxDays == 0 || rule.MaxAgeDays < maxDays) {
+			maxDays = rule.MaxAgeDays
+		}
+	}
+	if minDays > 0 {
+		t := file.CreatedAt.AddDate(0, 0, minDays)
+		s.RetainUntil = &t
+	}
+	if maxDays > 0 {
+		t := file.CreatedAt.AddDate(0, 0, max(maxDays, minDays))
+		s.ExpiresAt = &t
+	}
+	if s.Rules == nil {
+		s.Rules = []RetentionRule{}
+	}
+	return s
+}
+
+// deletable refuses deleting a file on legal hold or inside its minimum
+// retention.
+func (s retentionStatus) deletable() error {
+	if s.LegalHold {
+		return opError(http.StatusLocked, "file is under legal hold")
+	}
+	if s.RetainUntil != nil && time.Now().Before(*s.RetainUntil) {
+		return opError(http.StatusForbidden, "file is retained until "+s.RetainUntil.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// checkFileDeletable is the single check every delete and purge path goes
+// through.
+func checkFileDeletable(file File) error {
+	return loadRetentionRules().status(file).deletable()
+}
+
+// checkFolderDeletable refuses removing a folder a rule is attached to, and,
+// when the files below it go too, any of them that may not be deleted.
+func checkFolderDeletable(tx *gorm.DB, ids []uint, withFiles bool) error {
+	var attached int64
+	tx.Model(&RetentionRule{}).Where("folder_id IN ?", ids).Count(&attached)
+	if attached > 0 {
+		return opError(http.StatusConflict, "folder has a retention rule")
+	}
+	if !withFiles {
+		return nil
+	}
+	var files []File
+	tx.Where("folder_id IN ?", ids).Find(&files)
+	rules := loadRetentionRules()
+	for _, f := range files {
+		if err := rules.status(f).deletable(); err != nil {
+			return opError(err.(*fileOpError).Status, f.Filename+": "+err.Error())
+		}
+	}
+	return nil
+}
+
+// checkMoveRetained refuses moving files from below oldParent to below
+// newParent (nil is the root) when that takes them out of a folder rule
+// that still retains them: once out, they could be deleted early. Rules of
+// folders that move along, of tags and of the new parent's folders keep or
+// start applying and count towards the retention left.
+func checkMoveRetained(files []File, oldParent, newParent *uint) error {
+	rules := loadRetentionRules()
+	oldChain, newChain := rules.chain(oldParent), rules.chain(newParent)
+	lost := map[uint]bool{}
+	for _, id := range oldChain {
+		if !slices.Contains(newChain, id) {
+			lost[id] = true
+		}
+	}
+	var gained []RetentionRule
+	for _, rule := range rules.rules {
+		if rule.FolderID != nil && slices.Contains(newChain, *rule.FolderID) && !slices.Contains(oldChain, *rule.FolderID) {
+			gained = append(gained, rule)
+		}
+	}
+	now := time.Now()
+	for _, f := range files {
+		before := rules.status(f)
+		if before.RetainUntil == nil || !now.Before(*before.RetainUntil) {
+			continue
+		}
+		kept := slices.Clone(gained)
+		for _, rule := range before.Rules {
+			if rule.FolderID == nil || !lost[*rule.FolderID] {
+				kept = append(kept, rule)
+			}
+		}
+		after := statusUnder(f, kept)
+		if after.RetainUntil == nil || after.RetainUntil.Before(*before.RetainUntil) {
+			return opError(http.StatusConflict, f.Filename+": retained in its folder until "+before.RetainUntil.Format("2006-01-02"))
+		}
+	}
+	return nil
+}
+
+// purgeable splits trashed files into those that may be purged and those a
+// legal hold or retention rule keeps.
+func purgeable(files []File) (ok, kept []File) {
+	rules := loadRetentionRules()
+	for _, f := range files {
+		if rules.status(f).deletable() == nil {
+			ok = append(ok, f)
+		} else {
+			kept = append(kept, f)
+		}
+	}
+	return ok, kept
+}
+
+type expiringFile struct {
+	File      File      `json:"file"`
+	ExpiresAt time.Time `json:"expires_at"`
+	LegalHold bool      `json:"legal_hold"`
+}
+
+// expiringBefore lists the live files whose maximum age runs out before the
+// given time, soonest first. Held files are included and flagged.
+func (r *retentionRules) expiringBefore(before time.Time) []expiringFile {
+	seen := map[uint]bool{}
+	var out []expiringFile
+	for _, rule := range r.rules {
+		if rule.MaxAgeDays <= 0 {
+			continue
+		}
+		q := DB.Preload("Uploader").Where("created_at < ?", before.AddDate(0, 0, -rule.MaxAgeDays))
+		if rule.FolderID != nil {
+			q = q.Where("folder_id IN ?", folderDescendantIDs(*rule.FolderID))
+		} else {
+			q = q.Where(tagMatchSQL, strings.ToLower(rule.Tag))
+		}
+		var files []File
+		q.Find(&files)
+		for _, f := range files {
+			if seen[f.ID] {
+				continue
+			}
+			seen[f.ID] = true
+			if s := r.status(f); s.ExpiresAt != nil && s.ExpiresAt.Before(before) {
+				out = append(out, expiringFile{File: f, ExpiresAt: *s.ExpiresAt, LegalHold: f.LegalHold})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ExpiresAt.Before(out[j].ExpiresAt) })
+	return out
+}
+
+// expireRetainedFiles moves files past their maximum age to the trash,
+// where the trash retention takes over. Held files stay.
+func expireRetainedFiles() {
+	expired := 0
+	for _, e := range loadRetentionRules().expiringBefore(time.Now()) {
+		if e.LegalHold {
+			continue
+		}
+		if err := DB.Delete(&e.File).Error; err != nil {
+			log.Printf("retention expiry of file %d failed: %v", e.File.ID, err)
+			continue
+		}
+		expired++
+	}
+	if expired > 0 {
+		log.Printf("moved %d expired files to trash", expired)
+	}
+}
+
+// GET /files/:id/retention
+func FileRetentionHandler(c *gin.Context) {
+	_, file, ok := loadVersionedFile(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"file_id": file.ID, "retention": loadRetentionRules().status(file)})
+}
+
+// GET /admin/retention/rules
+func AdminListRetentionRules(c *gin.Context) {
+	var rules []RetentionRule
+	DB.Order("id").Find(&rules)
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+// POST /admin/retention/rules  { "folder_id": 3 | "tag": "invoices", "min_retention_days": 2555, "max_age_days": 0 }
+func AdminCreateRetentionRule(c *gin.Context) {
+	var body struct {
+		FolderID         *uint  `json:"folder_id"`
+		Tag              string `json:"tag"`
+		MinRetentionDays int    `json:"min_retention_days"`
+		MaxAgeDays       int    `json:"max_age_days"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+		return
+	}
+	body.Tag = strings.TrimSpace(body.Tag)
+	if (body.FolderID == nil) == (body.Tag == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "give either folder_id or tag"})
+		return
+	}
+	if body.MinRetentionDays < 0 || body.MaxAgeDays < 0 || body.MinRetentionDays+body.MaxAgeDays == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "min_retention_days and max_age_days must be 0 or more, and one of them set"})
+		return
+	}
+	if body.FolderID != nil {
+		var folder Folder
+		if err := DB.First(&folder, *body.FolderID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+			return
+		}
+	}
+	admin := c.MustGet("user").(User)
+	rule := RetentionRule{
+		FolderID:         body.FolderID,
+		Tag:              body.Tag,
+		MinRetentionDays: body.MinRetentionDays,
+		MaxAgeDays:       body.MaxAgeDays,
+		CreatedByID:      admin.ID,
+	}
+	if err := DB.Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save rule"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"rule": rule})
+}
+
+// DELETE /admin/retention/rules/:id
+func AdminDeleteRetentionRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule id"})
+		return
+	}
+	res := DB.Delete(&RetentionRule{}, id)
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// POST /admin/files/:id/legal-hold  { "hold": true, "reason": "case 2024-17" }
+//
+// Works on trashed files too, which are then kept out of every purge.
+func AdminSetLegalHold(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+	var body struct {
+		Hold   bool   `json:"hold"`
+		Reason string `json:"reason"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+		return
+	}
+	var file File
+	if err := DB.Unscoped().First(&file, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+	if !body.Hold {
+		body.Reason = ""
+	}
+	if err := DB.Unscoped().Model(&file).Updates(map[string]interface{}{
+		"legal_hold":  body.Hold,
+		"hold_reason": body.Reason,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"file_id": file.ID, "legal_hold": body.Hold, "hold_reason": body.Reason})
+}
+
+// GET /admin/retention/expiring?days=30
+func AdminExpiringFiles(c *gin.Context) {
+	days := 30
+	if s := c.Query("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid days"})
+			return
+		}
+		days = n
+	}
+	files := loadRetentionRules().expiringBefore(time.Now().AddDate(0, 0, days))
+	if files == nil {
+		files = []expiringFile{}
+	}
+	c.JSON(http.StatusOK, gin.H{"days": days, "count": len(files), "files": files})
+}
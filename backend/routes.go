@@ -1,18 +1,25 @@
 package main
 
 import (
+	"log"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
 func setupRouter() *gin.Engine {
 	r := gin.Default()
+	// ClientIP binds signed URLs and keys the rate limiter, so only the
+	// configured proxies may set it through X-Forwarded-For
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
 
 	// Enable CORS
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:5173"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "X-User"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "X-User", "X-Share-Password"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 	}))
@@ -29,18 +36,74 @@ func setupRouter() *gin.Engine {
 	r.DELETE("/files/:id", DeleteFileHandler)
 	r.GET("/files/:id/stats", FileStatsHandler)
 
+	// Versions
+	r.GET("/files/:id/versions", ListFileVersionsHandler)
+	r.POST("/files/:id/versions", UploadFileVersionHandler)
+	r.POST("/files/:id/versions/policy", SetVersionPolicyHandler)
+	r.GET("/files/:id/versions/:version/download", DownloadFileVersionHandler)
+	r.POST("/files/:id/versions/:version/restore", RestoreFileVersionHandler)
+	r.GET("/files/:id/versions/diff", DiffFileVersionsHandler)
+	r.GET("/files/:id/retention", FileRetentionHandler)
+
+	// Tags
+	r.GET("/tags", ListTagsHandler)
+	r.GET("/tags/autocomplete", TagAutocompleteHandler)
+	r.POST("/tags/:id/rename", RenameTagHandler)
+	r.POST("/tags/:id/merge", MergeTagHandler)
+	r.DELETE("/tags/:id", DeleteTagHandler)
+	r.GET("/files/:id/tags", ListFileTagsHandler)
+	r.POST("/files/:id/tags", SetFileTagsHandler)
+	r.PUT("/files/:id/tags", SetFileTagsHandler)
+	r.DELETE("/files/:id/tags/:tag", RemoveFileTagHandler)
+
+	// Custom metadata
+	r.GET("/files/:id/metadata", GetFileMetadataHandler)
+	r.PATCH("/files/:id/metadata", PatchFileMetadataHandler)
+
+	// Trash
+	r.GET("/trash", ListTrashHandler)
+	r.DELETE("/trash", EmptyTrashHandler)
+	r.POST("/trash/:id/restore", RestoreFileHandler)
+	r.DELETE("/trash/:id", PurgeFileHandler)
+
 	// Sharing & Download
 	r.POST("/files/:id/share", ShareFileHandler)
-	r.GET("/download/:token", PublicDownloadHandler)
+	r.GET("/download/:token", SharePageHandler)
+	r.GET("/download/:token/preview", SharePreviewHandler)
+	r.GET("/download/:token/file", PublicDownloadHandler)
+	r.POST("/download/:token/file", PublicDownloadHandler)
 
 	// Folders
 	r.POST("/folders", CreateFolderHandler)
 	r.GET("/folders", ListFoldersHandler)
 	r.GET("/folders/:id/files", ListFilesInFolderHandler)
+	r.GET("/folders/:id/children", ListFolderChildrenHandler)
+	r.GET("/folders/:id/path", FolderPathHandler)
+	r.POST("/folders/:id/move", MoveFolderHandler)
+	r.DELETE("/folders/:id", DeleteFolderHandler)
 	r.POST("/files/:id/move", MoveFileToFolderHandler)
+	r.POST("/files/:id/rename", RenameFileHandler)
+	r.POST("/files/:id/copy", CopyFileHandler)
+	r.POST("/folders/:id/rename", RenameFolderHandler)
+	r.POST("/folders/:id/copy", CopyFolderHandler)
+	r.POST("/batch", BatchHandler)
 	r.POST("/folders/:id/share", ShareFolderHandler)
 	r.GET("/download/folder/:token", DownloadFolderHandler)
 
+	// Signed, expiring download URLs
+	r.POST("/files/:id/signed-url", CreateFileSignedURLHandler)
+	r.POST("/files/:id/signed-url/rotate", RotateFileSignSecretHandler)
+	r.POST("/folders/:id/signed-url", CreateFolderSignedURLHandler)
+	r.POST("/folders/:id/signed-url/rotate", RotateFolderSignSecretHandler)
+	r.GET("/signed/:token", SignedDownloadHandler)
+
+	// Share links (password, expiry and download limits)
+	r.POST("/files/:id/links", CreateFileShareLinkHandler)
+	r.GET("/files/:id/links", ListFileShareLinksHandler)
+	r.POST("/folders/:id/links", CreateFolderShareLinkHandler)
+	r.GET("/folders/:id/links", ListFolderShareLinksHandler)
+	r.DELETE("/links/:id", RevokeShareLinkHandler)
+
 	// storage stats global & per-user
 	r.GET("/storage/stats", StorageStatsHandler)
 	r.GET("/stats", UserStatsHandler)
@@ -52,6 +115,15 @@ func setupRouter() *gin.Engine {
 		admin.GET("/files", AdminListFiles)
 		admin.GET("/stats", AdminStats)
 		admin.POST("/share/:fileID", AdminShareFile)
+		admin.GET("/retention/rules", AdminListRetentionRules)
+		admin.POST("/retention/rules", AdminCreateRetentionRule)
+		admin.DELETE("/retention/rules/:id", AdminDeleteRetentionRule)
+		admin.GET("/retention/expiring", AdminExpiringFiles)
+		admin.POST("/files/:id/legal-hold", AdminSetLegalHold)
+		admin.POST("/reindex", AdminReindexHandler)
+		admin.GET("/metadata-schemas", AdminListMetadataSchemas)
+		admin.PUT("/folders/:id/metadata-schema", AdminSetMetadataSchema)
+		admin.DELETE("/folders/:id/metadata-schema", AdminDeleteMetadataSchema)
 	}
 
 	// selective file share (user-level)
@@ -66,9 +138,35 @@ func setupRouter() *gin.Engine {
 	r.GET("/folders/:id/shared_with", ListFolderSharedWithHandler)
 	r.GET("/folders/:id/download", AuthDownloadFolderHandler)
 
+	// selective multi-file download (zip or tar.gz)
+	r.POST("/archive", DownloadArchiveHandler)
+
+	// path-addressed filesystem API
+	r.GET("/fs/*path", FSGetHandler)
+	r.PUT("/fs/*path", FSPutHandler)
+	r.DELETE("/fs/*path", FSDeleteHandler)
+
+	// WebDAV mount of the user's vault
+	dav := WebDAVHandler()
+	for _, m := range davMethods {
+		r.Handle(m, "/webdav/*path", dav)
+	}
+
+	// SSH keys for the SFTP server
+	r.POST("/ssh-keys", AddSSHKeyHandler)
+	r.GET("/ssh-keys", ListSSHKeysHandler)
+	r.DELETE("/ssh-keys/:id", DeleteSSHKeyHandler)
+
 	// search endpoint
 	r.GET("/search", SearchHandler)
 
+	// saved searches, also listed as smart folders
+	r.POST("/searches", CreateSavedSearchHandler)
+	r.GET("/searches", ListSavedSearchesHandler)
+	r.DELETE("/searches/:id", DeleteSavedSearchHandler)
+	r.GET("/searches/:id/run", RunSavedSearchHandler)
+	r.GET("/searches/:id/download", DownloadSavedSearchHandler)
+
 	r.GET("/realtime", RealtimeHandler)
 
 	return r
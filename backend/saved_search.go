@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxSmartFolderFiles caps how many files a smart folder download holds.
+const maxSmartFolderFiles = 5000
+
+// savedSearchParams are the search parameters a saved search may hold,
+// besides meta.<key> filters. Paging, all and facets belong to a single run
+// and are not saved.
+var savedSearchParams = []string{
+	"q", "text", "query", "mime", "minSize", "maxSize",
+	"startDate", "endDate", "tags", "uploader", "sort", "order",
+}
+
+// cleanSavedParams checks a query string of search parameters and returns
+// it normalised.
+func cleanSavedParams(raw string) (string, error) {
+	vals, err := url.ParseQuery(strings.TrimPrefix(raw, "?"))
+	if err != nil {
+		return "", errors.New("params must be a URL query string")
+	}
+	for k := range vals {
+		if !slices.Contains(savedSearchParams, k) && !strings.HasPrefix(k, "meta.") {
+			return "", errors.New("params cannot include " + strconv.Quote(k))
+		}
+	}
+	if expr := vals.Get("query"); expr != "" {
+		// only checked here; it compiles again for whoever runs the search
+		if _, err := parseSearchQuery(expr, 0); err != nil {
+			return "", err
+		}
+	}
+	if s := vals.Get("sort"); s != "" {
+		if _, ok := searchSortColumns[s]; !ok {
+			return "", errors.New("cannot sort by " + strconv.Quote(s))
+		}
+	}
+	if o := vals.Get("order"); o != "" && o != "asc" && o != "desc" {
+		return "", errors.New("order must be asc or desc")
+	}
+	return vals.Encode(), nil
+}
+
+// useSavedParams replaces the request's query string with the saved search
+// parameters, keeping the request's own values for the keep keys. It must
+// run before anything reads c.Query, which caches the first query string it
+// sees.
+func useSavedParams(c *gin.Context, s SavedSearch, keep ...string) {
+	vals, _ := url.ParseQuery(s.Params)
+	req := c.Request.URL.Query()
+	for _, k := range keep {
+		if v, ok := req[k]; ok {
+			vals[k] = v
+		}
+	}
+	c.Request.URL.RawQuery = vals.Encode()
+}
+
+// loadSavedSearch resolves :id to one of the caller's saved searches.
+func loadSavedSearch(c *gin.Context) (User, SavedSearch, bool) {
+	var s SavedSearch
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return user, s, false
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid search id"})
+		return user, s, false
+	}
+	if err := DB.Where("id = ? AND owner_id = ?", id, user.ID).First(&s).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "saved search not found"})
+		return user, s, false
+	}
+	return user, s, true
+}
+
+// userSavedSearches lists the user's saved searches by name.
+func userSavedSearches(user User) []SavedSearch {
+	searches := []SavedSearch{}
+	DB.Where("owner_id = ?", user.ID).Order("name").Find(&searches)
+	return searches
+}
+
+// POST /searches  { "name": "Invoices last week", "params": "query=tag:invoice uploaded:-7d.." }
+func CreateSavedSearchHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+	var body struct {
+		Name   string `json:"name"`
+		Params string `json:"params"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if !validFolderName(body.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid name"})
+		return
+	}
+	params, err := cleanSavedParams(body.Params)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var n int64
+	DB.Model(&SavedSearch{}).Where("owner_id = ? AND name = ?", user.ID, body.Name).Count(&n)
+	if n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a saved search with this name already exists"})
+		return
+	}
+	s := SavedSearch{OwnerID: user.ID, Name: body.Name, Params: params}
+	if err := DB.Create(&s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save search"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"search": s})
+}
+
+// GET /searches
+func ListSavedSearchesHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"searches": userSavedSearches(user)})
+}
+
+// DELETE /searches/:id
+func DeleteSavedSearchHandler(c *gin.Context) {
+	_, s, ok := loadSavedSearch(c)
+	if !ok {
+		return
+	}
+	if err := DB.Delete(&s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// GET /searches/:id/run?limit=100&cursor=...&facets=true
+//
+// Answers like GET /search with the saved parameters. The request may page
+// through the results, change the sort and ask for facets.
+func RunSavedSearchHandler(c *gin.Context) {
+	_, s, ok := loadSavedSearch(c)
+	if !ok {
+		return
+	}
+	useSavedParams(c, s, "limit", "cursor", "sort", "order", "facets")
+	SearchHandler(c)
+}
+
+// GET /searches/:id/download?format=zip
+//
+// Downloads the smart folder: every file the saved search currently finds.
+func DownloadSavedSearchHandler(c *gin.Context) {
+	user, s, ok := loadSavedSearch(c)
+	if !ok {
+		return
+	}
+	useSavedParams(c, s, "format")
+	format := c.DefaultQuery("format", "zip")
+	if format == "tgz" {
+		format = "tar.gz"
+	}
+	if _, ok := archiveFormats[format]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be zip or tar.gz"})
+		return
+	}
+
+	var files []File
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if c.Query("q") != "" {
+			if err := setFuzzyThreshold(tx); err != nil {
+				return err
+			}
+		}
+		db, ok, err := searchFilesQuery(c, tx, user, false)
+		if err != nil || !ok {
+			return err
+		}
+		return db.Order("files.filename, files.id").Limit(maxSmartFolderFiles + 1).Find(&files).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	if len(files) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "nothing to download"})
+		return
+	}
+	if len(files) > maxSmartFolderFiles {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "search finds more than " + strconv.Itoa(maxSmartFolderFiles) + " files; narrow it down"})
+		return
+	}
+
+	names := archiveNames{}
+	entries := make([]archiveEntry, 0, len(files))
+	for _, f := range files {
+		entries = append(entries, archiveEntry{Name: names.unique(f.Filename), File: f})
+	}
+	sendArchive(c, s.Name, format, entries, names)
+}
@@ -8,10 +8,41 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-func SearchHandler(c *gin.Context) {
-	q := c.Query("q")                // filename substring
+// fuzzyThreshold is how close (pg_trgm word similarity, 0..1) a filename
+// must come to q to match when it does not contain q literally.
+const fuzzyThreshold = 0.3
+
+// suggestThreshold is the looser similarity for "did you mean" suggestions.
+const suggestThreshold = 0.2
+
+// visibleFiles restricts q to the files user may open, by the same rules as
+// userHasAccessToFile: owned, public, shared directly, or inside a folder
+// that is owned by, shared with or public to the user, or below one.
+func visibleFiles(q *gorm.DB, user User) *gorm.DB {
+	return q.Where(`files.uploader_id = ? OR files.public
+		OR EXISTS (SELECT 1 FROM shared_file_access s WHERE s.file_id = files.id AND s.target_user_id = ?)
+		OR files.folder_id IN (
+			WITH RECURSIVE reachable AS (
+				SELECT id FROM folders
+				WHERE uploader_id = ? OR public
+				   OR id IN (SELECT folder_id FROM shared_folder_access WHERE target_user_id = ?)
+				UNION
+				SELECT f.id FROM folders f JOIN reachable o ON f.parent_id = o.id
+			)
+			SELECT id FROM reachable
+		)`, user.ID, user.ID, user.ID, user.ID)
+}
+
+// searchFilesQuery builds the file query on tx for the search filters in
+// the request. Unless all is set (admins only), it only sees what user can
+// open. ok is false when the filters can match nothing; err is a
+// *queryError when the query language expression does not parse.
+func searchFilesQuery(c *gin.Context, tx *gorm.DB, user User, all bool) (db *gorm.DB, ok bool, err error) {
+	q := c.Query("q")                // filename, matched fuzzily
+	expr := c.Query("query")         // query language, see query.go
 	mime := c.Query("mime")          // MIME type
 	minSizeStr := c.Query("minSize") // minimum size in bytes
 	maxSizeStr := c.Query("maxSize") // maximum size in bytes
@@ -19,12 +50,28 @@ func SearchHandler(c *gin.Context) {
 	endDateStr := c.Query("endDate")
 	tags := c.Query("tags")
 	uploaderName := c.Query("uploader")
+	text := c.Query("text") // full-text query over document contents
 
-	db := DB.Model(&File{}).Preload("Uploader")
+	db = tx.Model(&File{})
+	if !all {
+		db = visibleFiles(db, user)
+	}
 
 	// apply filters
+	if expr != "" {
+		cond, err := parseSearchQuery(expr, user.ID)
+		if err != nil {
+			return db, false, err
+		}
+		db = db.Where(cond.SQL, cond.Args...)
+	}
 	if q != "" {
-		db = db.Where("filename ILIKE ?", "%"+q+"%")
+		// both operators are served by the trigram index
+		db = db.Where("files.filename ILIKE ? OR ? <% files.filename", "%"+q+"%", q)
+	}
+	if text != "" {
+		db = db.Joins("JOIN blob_texts bt ON bt.hash = files.hash").
+			Where("bt.tsv @@ websearch_to_tsquery('english', ?)", text)
 	}
 	if mime != "" {
 		db = db.Where("content_type = ?", mime)
@@ -50,26 +97,192 @@ func SearchHandler(c *gin.Context) {
 		}
 	}
 	if tags != "" {
-		tagList := strings.Split(tags, ",")
-		for _, t := range tagList {
-			db = db.Where("tags ILIKE ?", "%"+strings.TrimSpace(t)+"%")
+		// every listed tag, matched exactly but ignoring case
+		for _, t := range strings.Split(tags, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				db = db.Where(tagMatchSQL, strings.ToLower(t))
+			}
 		}
 	}
+	db = metadataFilters(c, db)
 	if uploaderName != "" {
-		// join with users
 		var uploader User
 		if err := DB.Where("username ILIKE ?", uploaderName).First(&uploader).Error; err == nil {
 			db = db.Where("uploader_id = ?", uploader.ID)
 		} else if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusOK, gin.H{"files": []File{}})
+			return db, false, nil
+		}
+	}
+	return db, true, nil
+}
+
+// GET /search?q=...&text=...&query=...&mime=...&all=true&facets=true&sort=relevance&limit=100&cursor=...
+// (all: admins only, search every file; query: e.g. type:pdf size:>5MB -tag:draft;
+// facets: counts over all results by type, uploader, tag, size and month)
+func SearchHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+	all := c.Query("all") == "true" || c.Query("all") == "1"
+	if all && user.Role != "admin" && user.Username != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+		return
+	}
+	q, text := c.Query("q"), c.Query("text")
+	facets := c.Query("facets") == "true" || c.Query("facets") == "1"
+	defaultSort := "created_at"
+	if q != "" || text != "" {
+		defaultSort = sortRelevance
+	}
+	p, err := parsePage(c, "files", searchSortColumns, defaultSort)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if p.Sort == sortRelevance && q == "" && text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sorting by relevance needs q or text"})
+		return
+	}
+
+	if expr := c.Query("query"); expr != "" {
+		// reject a malformed query before touching the database
+		if _, err := parseSearchQuery(expr, user.ID); err != nil {
+			qerr := err.(*queryError)
+			c.JSON(http.StatusBadRequest, gin.H{"error": qerr.Error(), "position": qerr.Pos})
 			return
 		}
 	}
 
-	var results []File
-	if err := db.Find(&results).Error; err != nil {
+	resp := gin.H{}
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if q != "" {
+			if err := setFuzzyThreshold(tx); err != nil {
+				return err
+			}
+		}
+		db, ok, err := searchFilesQuery(c, tx, user, all)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			resp["files"], resp["total"], resp["next_cursor"] = []File{}, 0, nil
+			if facets {
+				resp["facets"] = map[string][]facetValue{}
+			}
+			return nil
+		}
+		db = db.Session(&gorm.Session{})
+		var total int64
+		if err := db.Count(&total).Error; err != nil {
+			return err
+		}
+		if facets {
+			if resp["facets"], err = searchFacets(tx, db); err != nil {
+				return err
+			}
+		}
+		db = p.apply(db)
+
+		var files []File
+		var matches []textMatch
+		if text != "" {
+			var err error
+			if files, matches, err = searchText(tx, db, text, p.Sort == sortRelevance); err != nil {
+				return err
+			}
+		} else {
+			if p.Sort == sortRelevance {
+				// literal matches first, then the closest fuzzy ones
+				db = db.Clauses(clause.OrderBy{Expression: clause.Expr{
+					SQL:  "files.filename ILIKE ? DESC, word_similarity(?, files.filename) DESC, files.id",
+					Vars: []interface{}{"%" + q + "%", q},
+				}})
+			}
+			if err := db.Preload("Uploader").Preload("Tags").Find(&files).Error; err != nil {
+				return err
+			}
+		}
+		files, next := pageOf(p, files, fileSortKey(p.Sort))
+		hideLocations(files, user.ID)
+		resp["files"], resp["total"], resp["next_cursor"] = files, total, next
+		if text != "" {
+			resp["matches"] = matches[:len(files)]
+		}
+		if len(files) == 0 && q != "" && p.after == nil {
+			resp["suggestions"] = filenameSuggestions(tx, user, all, q)
+		}
+		return nil
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"files": results})
+	c.JSON(http.StatusOK, resp)
+}
+
+// setFuzzyThreshold sets how closely q must match filenames for the rest of
+// the transaction tx, so pooled connections keep the default.
+func setFuzzyThreshold(tx *gorm.DB) error {
+	threshold := strconv.FormatFloat(fuzzyThreshold, 'f', -1, 64)
+	return tx.Exec("SELECT set_config('pg_trgm.word_similarity_threshold', ?, true)", threshold).Error
+}
+
+// filenameSuggestions returns up to five visible filenames resembling q,
+// closest first, for a search that found nothing.
+func filenameSuggestions(tx *gorm.DB, user User, all bool, q string) []string {
+	db := tx.Model(&File{})
+	if !all {
+		db = visibleFiles(db, user)
+	}
+	names := []string{}
+	db.Select("files.filename").
+		Where("word_similarity(?, files.filename) >= ?", q, suggestThreshold).
+		Group("files.filename").
+		Clauses(clause.OrderBy{Expression: clause.Expr{SQL: "MAX(word_similarity(?, files.filename)) DESC", Vars: []interface{}{q}}}).
+		Limit(5).
+		Pluck("files.filename", &names)
+	return names
+}
+
+// textMatch is the relevance and highlighted excerpt of one full-text hit.
+type textMatch struct {
+	FileID  uint    `json:"file_id"`
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+// searchText runs a search with a full-text query, best matching first when
+// byRank is set. Each file comes with a snippet where matched words are
+// wrapped in <mark>.
+func searchText(tx, db *gorm.DB, text string, byRank bool) ([]File, []textMatch, error) {
+	if byRank {
+		db = db.Order("rank DESC, files.id")
+	}
+	matches := []textMatch{}
+	err := db.Select(`files.id AS file_id,
+		ts_rank(bt.tsv, websearch_to_tsquery('english', ?)) AS rank,
+		ts_headline('english', bt.body, websearch_to_tsquery('english', ?),
+			'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=30, MinWords=10') AS snippet`, text, text).
+		Scan(&matches).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]uint, 0, len(matches))
+	for _, m := range matches {
+		ids = append(ids, m.FileID)
+	}
+	var found []File
+	tx.Preload("Uploader").Preload("Tags").Where("id IN ?", ids).Find(&found)
+	byID := make(map[uint]File, len(found))
+	for _, f := range found {
+		byID[f.ID] = f
+	}
+	files := make([]File, 0, len(matches))
+	for _, m := range matches {
+		files = append(files, byID[m.FileID])
+	}
+	return files, matches, nil
 }
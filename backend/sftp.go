@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+var errSFTPUnknownKey = errors.New("unknown public key")
+
+// runSFTPServer serves every user's vault over SFTP on addr. Users log in
+// with their username and one of the public keys registered via /ssh-keys.
+func runSFTPServer(addr string) error {
+	signer, err := loadSFTPHostKey(cfg.SFTPHostKey)
+	if err != nil {
+		return err
+	}
+	config := &ssh.ServerConfig{PublicKeyCallback: sftpAuthenticate}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Println("SFTP server running on " + addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSFTPConn(conn, config)
+	}
+}
+
+// loadSFTPHostKey reads the server's host key, generating an ed25519 key the
+// first time so clients see the same fingerprint across restarts.
+func loadSFTPHostKey(path string) (ssh.Signer, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(priv, "")
+		if err != nil {
+			return nil, err
+		}
+		b = pem.EncodeToMemory(block)
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("generated SFTP host key at %s", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(b)
+}
+
+// sftpAuthenticate accepts a key registered to the user named in the login.
+func sftpAuthenticate(conn ssh.ConnMetadata, pub ssh.PublicKey) (*ssh.Permissions, error) {
+	var key SSHKey
+	if err := DB.Where("fingerprint = ?", ssh.FingerprintSHA256(pub)).First(&key).Error; err != nil {
+		return nil, errSFTPUnknownKey
+	}
+	stored, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.PublicKey))
+	if err != nil || !bytes.Equal(stored.Marshal(), pub.Marshal()) {
+		return nil, errSFTPUnknownKey
+	}
+	var user User
+	if err := DB.First(&user, key.UserID).Error; err != nil || user.Username != conn.User() {
+		return nil, errSFTPUnknownKey
+	}
+	return &ssh.Permissions{Extensions: map[string]string{
+		"key-id":  strconv.FormatUint(uint64(key.ID), 10),
+		"user-id": strconv.FormatUint(uint64(user.ID), 10),
+	}}, nil
+}
+
+func serveSFTPConn(nc net.Conn, config *ssh.ServerConfig) {
+	defer nc.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		log.Printf("sftp handshake from %s failed: %v", nc.RemoteAddr(), err)
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	var user User
+	if err := DB.Where("id = ?", sconn.Permissions.Extensions["user-id"]).First(&user).Error; err != nil {
+		return
+	}
+	now := time.Now()
+	DB.Model(&SSHKey{}).Where("id = ?", sconn.Permissions.Extensions["key-id"]).Update("last_used_at", &now)
+	log.Printf("sftp: %s connected from %s", user.Username, nc.RemoteAddr())
+
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, requests, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSFTPSession(ch, requests, user)
+	}
+}
+
+// serveSFTPSession starts the sftp subsystem when the client asks for it;
+// shells and exec requests are refused.
+func serveSFTPSession(ch ssh.Channel, requests <-chan *ssh.Request, user User) {
+	started := false
+	for req := range requests {
+		// the subsystem name is an SSH string: 4-byte length, then the name
+		ok := !started && req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		started = true
+		go func() {
+			server := sftp.NewRequestServer(ch, sftpHandlers(user))
+			if err := server.Serve(); err != nil && err != io.EOF {
+				log.Printf("sftp session for %s ended: %v", user.Username, err)
+			}
+			server.Close()
+		}()
+	}
+}
+
+// sftpHandler maps SFTP requests onto the same tree WebDAV clients see.
+type sftpHandler struct {
+	user User
+}
+
+func sftpHandlers(user User) sftp.Handlers {
+	h := sftpHandler{user: user}
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+// sftpError gives permission errors their SFTP status code; everything else
+// is translated by pkg/sftp itself.
+func sftpError(err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return err
+}
+
+// Fileread serves a download and counts it like one made over HTTP.
+func (h sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	node, err := resolveMountPath(h.user, r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if node.File == nil {
+		return nil, errDavIsDir
+	}
+	f, err := os.Open(filepath.Join(cfg.UploadPath, node.File.Path))
+	if err != nil {
+		return nil, err
+	}
+	DB.Model(node.File).UpdateColumn("download_count", gorm.Expr("download_count + 1"))
+	notifyDownload(node.File.ID, node.File.DownloadCount+1)
+	return f, nil
+}
+
+// Filewrite buffers an upload in a temp file. Only whole-file writes are
+// supported: overwriting an existing file requires truncation.
+func (h sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	parentID, base, err := resolveMountParent(h.user, r.Filepath)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	if _, ok := findChildFolder(h.user.ID, parentID, base); ok {
+		return nil, errDavIsDir
+	}
+	flags := r.Pflags()
+	existing, exists := findFolderFile(h.user.ID, parentID, base)
+	switch {
+	case exists && flags.Excl:
+		return nil, os.ErrExist
+	case exists && (flags.Append || !flags.Trunc):
+		return nil, sftp.ErrSSHFxOpUnsupported
+	case !exists && !flags.Creat:
+		return nil, os.ErrNotExist
+	case exists && existing.LegalHold:
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	tmp, err := os.Create(tempUploadPath(base))
+	if err != nil {
+		return nil, err
+	}
+	w := &sftpWriter{tmp: tmp, user: h.user, folderID: parentID, name: base}
+	if exists {
+		w.existing = &existing
+	}
+	w.allowance = w.quotaLeft()
+	return w, nil
+}
+
+func (h sftpHandler) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		// modes and times are not stored; accept them so uploads with -p work
+		return nil
+	case "Mkdir":
+		return sftpError(mkdirMountPath(h.user, r.Filepath))
+	case "Rmdir", "Remove":
+		return sftpError(removeMountPath(h.user, r.Filepath, false))
+	case "Rename":
+		return sftpError(renameMountPath(h.user, r.Filepath, r.Target))
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	node, err := resolveMountPath(h.user, r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "List":
+		if node.File != nil {
+			return nil, os.ErrInvalid
+		}
+		return sftpLister(listMountDir(h.user, node)), nil
+	case "Stat":
+		return sftpLister{node.info()}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type sftpLister []os.FileInfo
+
+func (l sftpLister) ListAt(out []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(out, l[offset:])
+	if n < len(out) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpWriter collects an upload and, on Close, stores it through the same
+// MIME validation, hashing and dedup path as UploadHandler. Writes past the
+// user's remaining quota fail and discard the upload.
+type sftpWriter struct {
+	tmp       *os.File
+	user      User
+	folderID  *uint
+	name      string
+	existing  *File
+	allowance int64
+	aborted   atomic.Bool
+}
+
+// quotaLeft is how large the upload may grow; a replaced file frees its
+// current size.
+func (w *sftpWriter) quotaLeft() int64 {
+	left := cfg.StorageQuota - storageUsed(w.user.ID)
+	if w.existing != nil {
+		left += w.existing.Size
+	}
+	return left
+}
+
+func (w *sftpWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > w.allowance {
+		w.aborted.Store(true)
+		return 0, errQuotaExceeded
+	}
+	return w.tmp.WriteAt(p, off)
+}
+
+// TransferError is called by pkg/sftp when the connection drops mid-upload.
+func (w *sftpWriter) TransferError(err error) {
+	w.aborted.Store(true)
+}
+
+func (w *sftpWriter) Close() error {
+	tmpPath := w.tmp.Name()
+	info, err := w.tmp.Stat()
+	if cerr := w.tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || w.aborted.Load() {
+		os.Remove(tmpPath)
+		return err
+	}
+	// other sessions may have uploaded since the file was opened
+	if info.Size() > w.quotaLeft() {
+		os.Remove(tmpPath)
+		return errQuotaExceeded
+	}
+
+	// SFTP carries no content type, so the detected one is stored
+	if w.existing != nil {
+		blob, err := storeBlob(tmpPath, "")
+		if err != nil {
+			return err
+		}
+		_, err = addFileVersion(*w.existing, blob, w.user)
+		return err
+	}
+	_, _, err = ingestUpload(w.user, tmpPath, w.name, "", w.folderID)
+	return err
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -19,6 +20,18 @@ func generateToken() string {
 	return hex.EncodeToString(b)
 }
 
+// absoluteURL turns a server path into a link recipients can open directly.
+func absoluteURL(c *gin.Context, path string) string {
+	if cfg.PublicBaseURL != "" {
+		return strings.TrimRight(cfg.PublicBaseURL, "/") + path
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + path
+}
+
 // POST /files/:id/share  { "public": true }
 func ShareFileHandler(c *gin.Context) {
 	username := c.GetHeader("X-User")
@@ -62,14 +75,61 @@ func ShareFileHandler(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "unshared"})
 	}
 }
+
+// findSharedFile resolves a share link token or a legacy public token to its file.
+func findSharedFile(token string) (File, *ShareLink, bool) {
+	var file File
+	if link, ok := findShareLink(token, "file"); ok {
+		if err := DB.Preload("Uploader").First(&file, *link.FileID).Error; err != nil {
+			return File{}, nil, false
+		}
+		return file, &link, true
+	}
+	if err := DB.Preload("Uploader").Where("public_token = ?", token).First(&file).Error; err != nil {
+		return File{}, nil, false
+	}
+	return file, nil, true
+}
+
+// GET|POST /download/:token/file
 func PublicDownloadHandler(c *gin.Context) {
 	token := c.Param("token")
-	var file File
-	if err := DB.Where("public_token = ?", token).First(&file).Error; err != nil {
+	file, link, ok := findSharedFile(token)
+	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
 		return
 	}
 
+	// link-preview crawlers get the landing page instead of counting as a download
+	if isBot(c) {
+		c.Redirect(http.StatusFound, "/download/"+token)
+		return
+	}
+
+	// check the blob before a limited link spends a download on it
+	fullPath := filepath.Join(cfg.UploadPath, file.Path)
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "file missing"})
+		return
+	}
+
+	if link != nil {
+		// the landing page form posts here; answer it in HTML rather than JSON
+		if c.Request.Method == http.MethodPost && link.HasPassword {
+			if shareLinkLocked(*link) {
+				renderSharePage(c, http.StatusTooManyRequests, token, file, link, "Too many wrong passwords. Try again later.")
+				return
+			}
+			if !shareLinkPasswordOK(*link, shareLinkPassword(c)) {
+				renderSharePage(c, http.StatusForbidden, token, file, link, "Wrong password.")
+				return
+			}
+		}
+		if !useShareLink(c, *link) {
+			return
+		}
+	}
+
 	// atomically increment
 	if err := DB.Model(&file).Update("download_count", gorm.Expr("download_count + 1")).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update download count"})
@@ -81,11 +141,5 @@ func PublicDownloadHandler(c *gin.Context) {
 	DB.First(&updated, file.ID)
 	notifyDownload(updated.ID, updated.DownloadCount)
 
-	fullPath := filepath.Join(cfg.UploadPath, file.Path)
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "file missing"})
-		return
-	}
-
 	c.FileAttachment(fullPath, file.Filename)
 }
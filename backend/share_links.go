@@ -0,0 +1,303 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+type shareLinkRequest struct {
+	Label        string     `json:"label"`
+	Password     string     `json:"password"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxDownloads *int64     `json:"max_downloads"`
+}
+
+// newShareLink builds a link from the request body, hashing the password if one is set.
+func newShareLink(c *gin.Context, user User) (ShareLink, bool) {
+	var body shareLinkRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return ShareLink{}, false
+		}
+	}
+	if body.ExpiresAt != nil && body.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return ShareLink{}, false
+	}
+	if body.MaxDownloads != nil && *body.MaxDownloads <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_downloads must be positive"})
+		return ShareLink{}, false
+	}
+	link := ShareLink{
+		Token:        generateToken(),
+		Label:        body.Label,
+		ExpiresAt:    body.ExpiresAt,
+		MaxDownloads: body.MaxDownloads,
+		CreatedByID:  user.ID,
+	}
+	if body.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid password"})
+			return ShareLink{}, false
+		}
+		link.PasswordHash = string(hash)
+	}
+	return link, true
+}
+
+func withPasswordFlags(links []ShareLink) []ShareLink {
+	for i := range links {
+		links[i].HasPassword = links[i].PasswordHash != ""
+	}
+	return links
+}
+
+// findShareLink looks up a share link by token for the given kind ("file" or "folder").
+func findShareLink(token, kind string) (ShareLink, bool) {
+	var link ShareLink
+	q := DB.Where("token = ?", token)
+	if kind == "folder" {
+		q = q.Where("folder_id IS NOT NULL")
+	} else {
+		q = q.Where("file_id IS NOT NULL")
+	}
+	if err := q.First(&link).Error; err != nil {
+		return ShareLink{}, false
+	}
+	link.HasPassword = link.PasswordHash != ""
+	return link, true
+}
+
+// shareLinkPassword reads the password supplied for a protected link. It is
+// never taken from the URL, where it would end up in logs, browser history
+// and Referer headers.
+func shareLinkPassword(c *gin.Context) string {
+	if p := c.GetHeader("X-Share-Password"); p != "" {
+		return p
+	}
+	return c.PostForm("password")
+}
+
+const (
+	shareLinkMaxFailures = 5                // wrong passwords before a link locks
+	shareLinkLockout     = 15 * time.Minute // how long it stays locked
+)
+
+// shareLinkLocked reports whether too many wrong passwords locked the link.
+func shareLinkLocked(link ShareLink) bool {
+	return link.LockedUntil != nil && time.Now().Before(*link.LockedUntil)
+}
+
+// shareLinkPasswordOK checks the password against the link, counting a wrong
+// one and locking the link once shareLinkMaxFailures of them add up.
+func shareLinkPasswordOK(link ShareLink, password string) bool {
+	if bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)) == nil {
+		if link.FailedAttempts > 0 {
+			DB.Model(&ShareLink{}).Where("id = ?", link.ID).UpdateColumn("failed_attempts", 0)
+		}
+		return true
+	}
+	DB.Model(&ShareLink{}).Where("id = ?", link.ID).UpdateColumns(map[string]interface{}{
+		"failed_attempts": gorm.Expr("CASE WHEN failed_attempts + 1 >= ? THEN 0 ELSE failed_attempts + 1 END", shareLinkMaxFailures),
+		"locked_until":    gorm.Expr("CASE WHEN failed_attempts + 1 >= ? THEN ? ELSE locked_until END", shareLinkMaxFailures, time.Now().Add(shareLinkLockout)),
+	})
+	return false
+}
+
+// checkShareLink enforces expiry, download limit and password, writing the
+// error response and returning false when the link cannot be used.
+func checkShareLink(c *gin.Context, link ShareLink) bool {
+	if link.ExpiresAt != nil && time.Now().After(*link.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "link expired"})
+		return false
+	}
+	if link.MaxDownloads != nil && link.DownloadCount >= *link.MaxDownloads {
+		c.JSON(http.StatusGone, gin.H{"error": "download limit reached"})
+		return false
+	}
+	if link.PasswordHash != "" {
+		if shareLinkLocked(link) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many wrong passwords, try again later"})
+			return false
+		}
+		password := shareLinkPassword(c)
+		if password == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "password required"})
+			return false
+		}
+		if !shareLinkPasswordOK(link, password) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "wrong password"})
+			return false
+		}
+	}
+	return true
+}
+
+// recordShareLinkDownload bumps the link's counter unless the limit was hit
+// concurrently; false means the download must be refused.
+func recordShareLinkDownload(link ShareLink) (bool, error) {
+	res := DB.Model(&ShareLink{}).
+		Where("id = ? AND (max_downloads IS NULL OR download_count < max_downloads)", link.ID).
+		UpdateColumn("download_count", gorm.Expr("download_count + 1"))
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// useShareLink validates the link and records the download.
+func useShareLink(c *gin.Context, link ShareLink) bool {
+	if !checkShareLink(c, link) {
+		return false
+	}
+	ok, err := recordShareLinkDownload(link)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update download count"})
+		return false
+	}
+	if !ok {
+		c.JSON(http.StatusGone, gin.H{"error": "download limit reached"})
+		return false
+	}
+	return true
+}
+
+// POST /files/:id/links  { "label": "client", "password": "...", "expires_at": "...", "max_downloads": 5 }
+func CreateFileShareLinkHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	var file File
+	if err := DB.First(&file, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+	if file.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only uploader can share"})
+		return
+	}
+	link, ok := newShareLink(c, user)
+	if !ok {
+		return
+	}
+	link.FileID = &file.ID
+	if err := DB.Create(&link).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create link"})
+		return
+	}
+	link.HasPassword = link.PasswordHash != ""
+	c.JSON(http.StatusOK, gin.H{"link": link, "url": absoluteURL(c, "/download/"+link.Token)})
+}
+
+// GET /files/:id/links
+func ListFileShareLinksHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	var file File
+	if err := DB.First(&file, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+	if file.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only uploader can list links"})
+		return
+	}
+	var links []ShareLink
+	DB.Where("file_id = ?", file.ID).Order("created_at").Find(&links)
+	c.JSON(http.StatusOK, gin.H{"links": withPasswordFlags(links)})
+}
+
+// POST /folders/:id/links
+func CreateFolderShareLinkHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	var folder Folder
+	if err := DB.First(&folder, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+	if folder.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only owner can share folder"})
+		return
+	}
+	link, ok := newShareLink(c, user)
+	if !ok {
+		return
+	}
+	link.FolderID = &folder.ID
+	if err := DB.Create(&link).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create link"})
+		return
+	}
+	link.HasPassword = link.PasswordHash != ""
+	c.JSON(http.StatusOK, gin.H{"link": link, "url": absoluteURL(c, "/download/folder/"+link.Token)})
+}
+
+// GET /folders/:id/links
+func ListFolderShareLinksHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	var folder Folder
+	if err := DB.First(&folder, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+	if folder.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only owner can list links"})
+		return
+	}
+	var links []ShareLink
+	DB.Where("folder_id = ?", folder.ID).Order("created_at").Find(&links)
+	c.JSON(http.StatusOK, gin.H{"links": withPasswordFlags(links)})
+}
+
+// DELETE /links/:id
+func RevokeShareLinkHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	var link ShareLink
+	if err := DB.First(&link, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "link not found"})
+		return
+	}
+	if link.CreatedByID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only owner can revoke link"})
+		return
+	}
+	if err := DB.Delete(&link).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke link"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "revoked", "link_id": link.ID})
+}
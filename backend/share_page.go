@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const textPreviewBytes = 4096
+
+// previewImageTypes are the image types safe to render inline; SVG is left out
+// because it can carry script.
+var previewImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+}
+
+// botUserAgents are substrings of user agents used by crawlers and link
+// unfurlers (chat apps, social networks) that fetch shared links.
+var botUserAgents = []string{
+	"bot", "crawler", "spider", "slurp", "facebookexternalhit", "facebookcatalog",
+	"whatsapp", "skypeuripreview", "embedly", "vkshare", "pinterest", "redditbot",
+	"bitlybot", "quora link preview", "outbrain", "nuzzel", "preview",
+}
+
+func isBot(c *gin.Context) bool {
+	ua := strings.ToLower(c.GetHeader("User-Agent"))
+	if ua == "" {
+		return false
+	}
+	for _, b := range botUserAgents {
+		if strings.Contains(ua, b) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func baseMime(contentType string) string {
+	return strings.TrimSpace(strings.Split(contentType, ";")[0])
+}
+
+type sharePageData struct {
+	Title       string
+	Description string
+	PageURL     string
+	ImageURL    string
+	Filename    string
+	Size        string
+	ContentType string
+	Uploader    string
+	UploadedAt  string
+	TextPreview string
+	DownloadURL string
+	Password    bool
+	Unavailable string
+	Error       string
+}
+
+var sharePageTemplate = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<meta name="description" content="{{.Description}}">
+<meta property="og:type" content="website">
+<meta property="og:site_name" content="File Vault">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.PageURL}}">
+{{if .ImageURL}}<meta property="og:image" content="{{.ImageURL}}">
+<meta name="twitter:card" content="summary_large_image">{{else}}<meta name="twitter:card" content="summary">{{end}}
+<meta name="robots" content="noindex">
+<style>
+body{font-family:system-ui,sans-serif;background:#f3f4f6;margin:0;padding:2rem;color:#111827}
+.card{max-width:40rem;margin:0 auto;background:#fff;border-radius:.75rem;padding:1.5rem;box-shadow:0 1px 3px rgba(0,0,0,.1)}
+h1{font-size:1.25rem;word-break:break-all;margin-top:0}
+dl{display:grid;grid-template-columns:auto 1fr;gap:.25rem 1rem;font-size:.9rem}
+dt{color:#6b7280}
+img{max-width:100%;border-radius:.5rem;margin:1rem 0}
+pre{background:#f9fafb;padding:1rem;border-radius:.5rem;overflow:auto;max-height:20rem;font-size:.8rem}
+button{background:#2563eb;color:#fff;border:0;border-radius:.5rem;padding:.6rem 1.2rem;font-size:1rem;cursor:pointer}
+input{padding:.5rem;border:1px solid #d1d5db;border-radius:.5rem;margin-right:.5rem}
+.error{color:#b91c1c}
+</style>
+</head>
+<body>
+<div class="card">
+<h1>{{.Filename}}</h1>
+<dl>
+<dt>Size</dt><dd>{{.Size}}</dd>
+<dt>Type</dt><dd>{{.ContentType}}</dd>
+<dt>Shared by</dt><dd>{{.Uploader}}</dd>
+<dt>Uploaded</dt><dd>{{.UploadedAt}}</dd>
+</dl>
+{{if .ImageURL}}<img src="{{.ImageURL}}" alt="{{.Filename}}">{{end}}
+{{if .TextPreview}}<pre>{{.TextPreview}}</pre>{{end}}
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Unavailable}}<p class="error">{{.Unavailable}}</p>{{else}}
+<form method="post" action="{{.DownloadURL}}">
+{{if .Password}}<input type="password" name="password" placeholder="Password" required>{{end}}
+<button type="submit">Download</button>
+</form>{{end}}
+</div>
+</body>
+</html>`))
+
+// shareLinkUnavailable explains why a link can no longer be downloaded, or
+// returns "" when it is still usable.
+func shareLinkUnavailable(link *ShareLink) string {
+	if link == nil {
+		return ""
+	}
+	if link.ExpiresAt != nil && time.Now().After(*link.ExpiresAt) {
+		return "This link has expired."
+	}
+	if link.MaxDownloads != nil && link.DownloadCount >= *link.MaxDownloads {
+		return "This link has reached its download limit."
+	}
+	return ""
+}
+
+// canPreview reports whether the landing page may show the file contents.
+// Password-protected, expired and download-limited links only show the file
+// details: previews are not counted, so they would get around the limit.
+func canPreview(link *ShareLink) bool {
+	return link == nil || (!link.HasPassword && link.MaxDownloads == nil && shareLinkUnavailable(link) == "")
+}
+
+func renderSharePage(c *gin.Context, status int, token string, file File, link *ShareLink, errMsg string) {
+	data := sharePageData{
+		Title:       file.Filename,
+		Description: fmt.Sprintf("%s · %s · shared by %s", formatBytes(file.Size), baseMime(file.ContentType), file.Uploader.Username),
+		PageURL:     absoluteURL(c, "/download/"+token),
+		Filename:    file.Filename,
+		Size:        formatBytes(file.Size),
+		ContentType: baseMime(file.ContentType),
+		Uploader:    file.Uploader.Username,
+		UploadedAt:  file.CreatedAt.Format("2 Jan 2006"),
+		DownloadURL: "/download/" + token + "/file",
+		Password:    link != nil && link.HasPassword,
+		Unavailable: shareLinkUnavailable(link),
+		Error:       errMsg,
+	}
+	if link != nil && link.Label != "" {
+		data.Title = file.Filename + " (" + link.Label + ")"
+	}
+	if canPreview(link) {
+		mimeType := baseMime(file.ContentType)
+		if previewImageTypes[mimeType] {
+			data.ImageURL = absoluteURL(c, "/download/"+token+"/preview")
+		} else if strings.HasPrefix(mimeType, "text/") {
+			data.TextPreview = readTextPreview(filepath.Join(cfg.UploadPath, file.Path))
+		}
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	if err := sharePageTemplate.Execute(c.Writer, data); err != nil {
+		c.Error(err)
+	}
+}
+
+// readTextPreview returns the start of a text blob, cut at a valid UTF-8 boundary.
+func readTextPreview(fullPath string) string {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, textPreviewBytes)
+	n, _ := io.ReadFull(f, buf)
+	buf = buf[:n]
+	for len(buf) > 0 && !utf8.Valid(buf) {
+		buf = buf[:len(buf)-1]
+	}
+	if n == textPreviewBytes {
+		return string(buf) + "\n…"
+	}
+	return string(buf)
+}
+
+// GET /download/:token
+func SharePageHandler(c *gin.Context) {
+	token := c.Param("token")
+	file, link, ok := findSharedFile(token)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+	status := http.StatusOK
+	if shareLinkUnavailable(link) != "" {
+		status = http.StatusGone
+	}
+	renderSharePage(c, status, token, file, link, "")
+}
+
+// GET /download/:token/preview (inline image used as thumbnail and og:image; not counted)
+func SharePreviewHandler(c *gin.Context) {
+	file, link, ok := findSharedFile(c.Param("token"))
+	if !ok || !canPreview(link) || !previewImageTypes[baseMime(file.ContentType)] {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no preview available"})
+		return
+	}
+	fullPath := filepath.Join(cfg.UploadPath, file.Path)
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file missing"})
+		return
+	}
+	c.Header("Content-Type", baseMime(file.ContentType))
+	c.Header("Content-Disposition", "inline")
+	c.Header("X-Content-Type-Options", "nosniff")
+	// private: a shared cache could keep serving it after the link expires
+	// or is revoked
+	c.Header("Cache-Control", "private, max-age=300")
+	c.File(fullPath)
+}
@@ -1,8 +1,6 @@
 package main
 
 import (
-	"archive/zip"
-	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -51,7 +49,11 @@ func userHasAccessToFile(user User, file File) bool {
 	// check shared_file_access
 	var count int64
 	DB.Raw("SELECT COUNT(1) FROM shared_file_access WHERE file_id = ? AND target_user_id = ?", file.ID, user.ID).Scan(&count)
-	return count > 0
+	if count > 0 {
+		return true
+	}
+	// inside a folder (or subfolder of one) that is shared or public
+	return file.FolderID != nil && folderChainAccessible(*file.FolderID, user.ID)
 }
 
 func userHasAccessToFolder(user User, folder Folder) bool {
@@ -64,9 +66,8 @@ func userHasAccessToFolder(user User, folder Folder) bool {
 	if folder.Public {
 		return true
 	}
-	var count int64
-	DB.Raw("SELECT COUNT(1) FROM shared_folder_access WHERE folder_id = ? AND target_user_id = ?", folder.ID, user.ID).Scan(&count)
-	return count > 0
+	// shared or public directly, or through one of its parent folders
+	return folderChainAccessible(folder.ID, user.ID)
 }
 
 // POST /files/:id/share/user
@@ -323,34 +324,5 @@ func AuthDownloadFolderHandler(c *gin.Context) {
 		return
 	}
 
-	// find files in folder and stream zip
-	var files []File
-	DB.Where("folder_id = ?", folder.ID).Find(&files)
-	if len(files) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "folder empty"})
-		return
-	}
-
-	zipName := folder.Name + ".zip"
-	c.Header("Content-Disposition", "attachment; filename=\""+zipName+"\"")
-	c.Header("Content-Type", "application/zip")
-
-	zw := zip.NewWriter(c.Writer)
-	defer zw.Close()
-
-	for _, f := range files {
-		DB.Model(&f).UpdateColumn("download_count", f.DownloadCount+1)
-		fullPath := filepath.Join(cfg.UploadPath, f.Path)
-		fi, err := os.Open(fullPath)
-		if err != nil {
-			continue
-		}
-		info, _ := fi.Stat()
-		hdr, _ := zip.FileInfoHeader(info)
-		hdr.Name = f.Filename
-		hdr.Method = zip.Deflate
-		w, _ := zw.CreateHeader(hdr)
-		io.Copy(w, fi)
-		fi.Close()
-	}
+	streamFolderZip(c, folder)
 }
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const defaultSignedURLTTL = 3600 // seconds
+
+// signedURLClaims is the payload carried inside a signed download token.
+// The signature covers the whole payload, so none of it can be altered.
+type signedURLClaims struct {
+	Kind    string `json:"k"` // "file" or "folder"
+	ID      uint   `json:"id"`
+	Expires int64  `json:"exp"`
+	IP      string `json:"ip,omitempty"`
+	MaxUses int    `json:"max,omitempty"`
+	Nonce   string `json:"n"`
+	KeyID   string `json:"kid"` // fingerprint of the object's sign secret
+}
+
+type signedURLRequest struct {
+	TTLSeconds int64  `json:"ttl_seconds"`
+	BindIP     bool   `json:"bind_ip"`
+	IP         string `json:"ip"`
+	MaxUses    int    `json:"max_uses"`
+}
+
+var (
+	errSignedURLMalformed = errors.New("malformed signed url")
+	errSignedURLSignature = errors.New("invalid signature")
+	errSignedURLExpired   = errors.New("signed url expired")
+	errSignedURLIP        = errors.New("signed url not valid from this address")
+)
+
+// secretKeyID fingerprints a per-object secret so tokens can reference it
+// without revealing it.
+func secretKeyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+func signPayload(payload string) string {
+	mac := hmac.New(sha256.New, []byte(cfg.SignedURLKey))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func encodeSignedToken(claims signedURLClaims) (string, error) {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + signPayload(payload), nil
+}
+
+// canonicalIP returns the usual text form of an address, with IPv4-mapped
+// IPv6 addresses as plain IPv4, or "" when s is not an address.
+func canonicalIP(s string) string {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.String()
+}
+
+// decodeSignedToken checks the signature, expiry and IP binding. It only needs
+// the server key, so forged or stale tokens are rejected before touching the DB.
+func decodeSignedToken(token, clientIP string) (signedURLClaims, error) {
+	var claims signedURLClaims
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || payload == "" || sig == "" {
+		return claims, errSignedURLMalformed
+	}
+	if !hmac.Equal([]byte(sig), []byte(signPayload(payload))) {
+		return claims, errSignedURLSignature
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return claims, errSignedURLMalformed
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return claims, errSignedURLMalformed
+	}
+	if time.Now().Unix() > claims.Expires {
+		return claims, errSignedURLExpired
+	}
+	if claims.IP != "" && claims.IP != canonicalIP(clientIP) {
+		return claims, errSignedURLIP
+	}
+	return claims, nil
+}
+
+// recordSignedURLUse records one use of a max-use token and reports whether
+// the limit still allowed it.
+func recordSignedURLUse(claims signedURLClaims) (bool, error) {
+	if claims.MaxUses <= 0 {
+		return true, nil
+	}
+	res := DB.Exec(`
+		INSERT INTO signed_url_uses (nonce, uses, expires_at) VALUES (?, 1, ?)
+		ON CONFLICT (nonce) DO UPDATE SET uses = signed_url_uses.uses + 1
+		WHERE signed_url_uses.uses < ?
+	`, claims.Nonce, time.Unix(claims.Expires, 0), claims.MaxUses)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// mintSignedURL validates the request body and responds with a fresh signed URL.
+func mintSignedURL(c *gin.Context, kind string, id uint, secret string) {
+	var body signedURLRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+	}
+	if body.TTLSeconds == 0 {
+		body.TTLSeconds = defaultSignedURLTTL
+	}
+	if body.TTLSeconds < 0 || body.TTLSeconds > cfg.SignedURLMaxTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl_seconds out of range", "max_ttl_seconds": cfg.SignedURLMaxTTL})
+		return
+	}
+	if body.MaxUses < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_uses must not be negative"})
+		return
+	}
+	ip := body.IP
+	if ip != "" {
+		if ip = canonicalIP(ip); ip == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ip is not a valid address"})
+			return
+		}
+	} else if body.BindIP {
+		ip = canonicalIP(c.ClientIP())
+	}
+
+	claims := signedURLClaims{
+		Kind:    kind,
+		ID:      id,
+		Expires: time.Now().Add(time.Duration(body.TTLSeconds) * time.Second).Unix(),
+		IP:      ip,
+		MaxUses: body.MaxUses,
+		Nonce:   generateToken(),
+		KeyID:   secretKeyID(secret),
+	}
+	token, err := encodeSignedToken(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not sign url"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"url":        absoluteURL(c, "/signed/"+token),
+		"token":      token,
+		"expires_at": time.Unix(claims.Expires, 0).UTC(),
+		"ip":         claims.IP,
+		"max_uses":   claims.MaxUses,
+	})
+}
+
+// POST /files/:id/signed-url  { "ttl_seconds": 3600, "bind_ip": true, "max_uses": 3 }
+func CreateFileSignedURLHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	var file File
+	if err := DB.First(&file, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+	if file.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only uploader can sign urls"})
+		return
+	}
+	if file.SignSecret == "" {
+		file.SignSecret = generateToken()
+		if err := DB.Model(&file).Update("sign_secret", file.SignSecret).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not store sign secret"})
+			return
+		}
+	}
+	mintSignedURL(c, "file", file.ID, file.SignSecret)
+}
+
+// POST /folders/:id/signed-url
+func CreateFolderSignedURLHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	var folder Folder
+	if err := DB.First(&folder, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+	if folder.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only owner can sign urls"})
+		return
+	}
+	if folder.SignSecret == "" {
+		folder.SignSecret = generateToken()
+		if err := DB.Model(&folder).Update("sign_secret", folder.SignSecret).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not store sign secret"})
+			return
+		}
+	}
+	mintSignedURL(c, "folder", folder.ID, folder.SignSecret)
+}
+
+// POST /files/:id/signed-url/rotate (revokes every signed url for the file)
+func RotateFileSignSecretHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	var file File
+	if err := DB.First(&file, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+	if file.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only uploader can revoke signed urls"})
+		return
+	}
+	if err := DB.Model(&file).Update("sign_secret", generateToken()).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not rotate secret"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "rotated", "file_id": file.ID})
+}
+
+// POST /folders/:id/signed-url/rotate
+func RotateFolderSignSecretHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	var folder Folder
+	if err := DB.First(&folder, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+	if folder.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only owner can revoke signed urls"})
+		return
+	}
+	if err := DB.Model(&folder).Update("sign_secret", generateToken()).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not rotate secret"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "rotated", "folder_id": folder.ID})
+}
+
+// GET /signed/:token
+func SignedDownloadHandler(c *gin.Context) {
+	claims, err := decodeSignedToken(c.Param("token"), c.ClientIP())
+	switch err {
+	case nil:
+	case errSignedURLExpired:
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	case errSignedURLIP, errSignedURLSignature:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch claims.Kind {
+	case "file":
+		var file File
+		if err := DB.First(&file, claims.ID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+			return
+		}
+		if file.SignSecret == "" || secretKeyID(file.SignSecret) != claims.KeyID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "signed url revoked"})
+			return
+		}
+		fullPath := filepath.Join(cfg.UploadPath, file.Path)
+		if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "file missing"})
+			return
+		}
+		if !consumeSignedURL(c, claims) {
+			return
+		}
+		if err := DB.Model(&file).Update("download_count", gorm.Expr("download_count + 1")).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update download count"})
+			return
+		}
+		var updated File
+		DB.First(&updated, file.ID)
+		notifyDownload(updated.ID, updated.DownloadCount)
+		c.FileAttachment(fullPath, file.Filename)
+	case "folder":
+		var folder Folder
+		if err := DB.First(&folder, claims.ID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+			return
+		}
+		if folder.SignSecret == "" || secretKeyID(folder.SignSecret) != claims.KeyID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "signed url revoked"})
+			return
+		}
+		if !consumeSignedURL(c, claims) {
+			return
+		}
+		streamFolderZip(c, folder)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": errSignedURLMalformed.Error()})
+	}
+}
+
+// pruneSignedURLUses drops the use counters of expired signed URLs. Rows
+// from before expires_at was recorded go once the longest TTL has passed.
+func pruneSignedURLUses() {
+	res := DB.Exec(`DELETE FROM signed_url_uses
+		WHERE expires_at < now() OR (expires_at IS NULL AND created_at < ?)`,
+		time.Now().Add(-time.Duration(cfg.SignedURLMaxTTL)*time.Second))
+	if res.Error != nil {
+		log.Printf("signed url use pruning failed: %v", res.Error)
+	}
+}
+
+// consumeSignedURL applies the max-use limit, writing the error response when
+// the token can no longer be used.
+func consumeSignedURL(c *gin.Context, claims signedURLClaims) bool {
+	ok, err := recordSignedURLUse(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not record use"})
+		return false
+	}
+	if !ok {
+		c.JSON(http.StatusGone, gin.H{"error": "signed url use limit reached"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+)
+
+// POST /ssh-keys  { "public_key": "ssh-ed25519 AAAA... laptop", "label": "laptop" }
+func AddSSHKeyHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+	var body struct {
+		PublicKey string `json:"public_key"`
+		Label     string `json:"label"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+		return
+	}
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(body.PublicKey)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid public key"})
+		return
+	}
+	if body.Label == "" {
+		body.Label = comment
+	}
+
+	key := SSHKey{
+		UserID:      user.ID,
+		Label:       body.Label,
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+		Fingerprint: ssh.FingerprintSHA256(pub),
+	}
+	var count int64
+	DB.Model(&SSHKey{}).Where("fingerprint = ?", key.Fingerprint).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "key already registered"})
+		return
+	}
+	if err := DB.Create(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save key"})
+		return
+	}
+	c.JSON(http.StatusCreated, key)
+}
+
+// GET /ssh-keys
+func ListSSHKeysHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+	var keys []SSHKey
+	DB.Where("user_id = ?", user.ID).Order("created_at DESC").Find(&keys)
+	c.JSON(http.StatusOK, keys)
+}
+
+// DELETE /ssh-keys/:id
+func DeleteSSHKeyHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key id"})
+		return
+	}
+	var key SSHKey
+	if err := DB.First(&key, id).Error; err != nil || key.UserID != user.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "key not found"})
+		return
+	}
+	if err := DB.Delete(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
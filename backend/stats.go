@@ -38,7 +38,7 @@ func UserStatsHandler(c *gin.Context) {
 	DB.Raw(`
         SELECT MIN(size) AS size, hash
         FROM files
-        WHERE uploader_id = ?
+        WHERE uploader_id = ? AND deleted_at IS NULL
         GROUP BY hash
     `, user.ID).Scan(&rows)
 
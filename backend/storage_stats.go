@@ -13,7 +13,7 @@ func StorageStatsHandler(c *gin.Context) {
 	var deduped int64
 	DB.Raw(`
 		SELECT COALESCE(SUM(min_size),0) FROM (
-			SELECT MIN(size) AS min_size, hash FROM files GROUP BY hash
+			SELECT MIN(size) AS min_size, hash FROM files WHERE deleted_at IS NULL GROUP BY hash
 		) t
 	`).Scan(&deduped)
 
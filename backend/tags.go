@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxTagLength = 100
+
+// cleanTagName trims a tag name and checks it. Commas are refused because
+// the tags search parameter is comma-separated.
+func cleanTagName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return "", errors.New("tag name required")
+	case len(name) > maxTagLength:
+		return "", errors.New("tag name too long")
+	case strings.Contains(name, ","):
+		return "", errors.New("tag names cannot contain commas")
+	}
+	return name, nil
+}
+
+// ensureTags returns the owner's tags with the given names, creating the
+// missing ones. Names differing only in case are one tag.
+func ensureTags(tx *gorm.DB, ownerID uint, names []string) ([]Tag, error) {
+	seen := map[string]bool{}
+	var tags []Tag
+	for _, raw := range names {
+		name, err := cleanTagName(raw)
+		if err != nil {
+			return nil, opError(http.StatusBadRequest, err.Error())
+		}
+		if seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		var tag Tag
+		err = tx.Where("owner_id = ? AND lower(name) = lower(?)", ownerID, name).
+			Attrs(Tag{OwnerID: ownerID, Name: name}).
+			FirstOrCreate(&tag).Error
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// fileTagNames returns the lowercased names of the file's tags.
+func fileTagNames(tx *gorm.DB, fileID uint) []string {
+	var names []string
+	tx.Table("tags").
+		Joins("JOIN file_tags ft ON ft.tag_id = tags.id").
+		Where("ft.file_id = ?", fileID).
+		Pluck("lower(tags.name)", &names)
+	return names
+}
+
+// copyFileTags gives to the tags of from, in the namespace of to's owner.
+func copyFileTags(tx *gorm.DB, from, to File) error {
+	var names []string
+	tx.Table("tags").
+		Joins("JOIN file_tags ft ON ft.tag_id = tags.id").
+		Where("ft.file_id = ?", from.ID).
+		Pluck("tags.name", &names)
+	if len(names) == 0 {
+		return nil
+	}
+	tags, err := ensureTags(tx, to.UploaderID, names)
+	if err != nil {
+		return err
+	}
+	return tx.Model(&to).Association("Tags").Append(tags)
+}
+
+// checkTagUnlocked refuses changing a tag a retention rule selects files
+// by, since renaming or removing it would release them from the rule.
+func checkTagUnlocked(tx *gorm.DB, names ...string) error {
+	for _, name := range names {
+		var n int64
+		tx.Model(&RetentionRule{}).Where("lower(tag) = lower(?)", name).Count(&n)
+		if n > 0 {
+			return opError(http.StatusConflict, "tag "+strconv.Quote(name)+" is used by a retention rule")
+		}
+	}
+	return nil
+}
+
+// tagWithCount is a tag with the number of live files carrying it.
+type tagWithCount struct {
+	Tag
+	Files int64 `json:"files"`
+}
+
+// userTags lists the user's tags with their file counts; filter narrows
+// the query further.
+func userTags(user User, filter func(*gorm.DB) *gorm.DB) []tagWithCount {
+	tags := []tagWithCount{}
+	q := DB.Table("tags").
+		Select("tags.*, COUNT(f.id) AS files").
+		Joins("LEFT JOIN file_tags ft ON ft.tag_id = tags.id").
+		Joins("LEFT JOIN files f ON f.id = ft.file_id AND f.deleted_at IS NULL").
+		Where("tags.owner_id = ?", user.ID).
+		Group("tags.id")
+	filter(q).Scan(&tags)
+	return tags
+}
+
+// GET /tags
+func ListTagsHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+	tags := userTags(user, func(q *gorm.DB) *gorm.DB { return q.Order("lower(tags.name)") })
+	c.JSON(http.StatusOK, gin.H{"tags": tags})
+}
+
+// GET /tags/autocomplete?q=inv&limit=10
+//
+// Tags starting with q come first, then those containing it; within each,
+// the most used first.
+func TagAutocompleteHandler(c *gin.Context) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return
+	}
+	limit := 10
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = min(n, 100)
+	}
+	prefix := likePattern(strings.TrimSpace(c.Query("q")))
+	tags := userTags(user, func(q *gorm.DB) *gorm.DB {
+		return q.Where("tags.name ILIKE ?", "%"+prefix+"%").
+			Clauses(clause.OrderBy{Expression: clause.Expr{
+				SQL:  "tags.name ILIKE ? DESC, files DESC, lower(tags.name)",
+				Vars: []interface{}{prefix + "%"},
+			}}).
+			Limit(limit)
+	})
+	c.JSON(http.StatusOK, gin.H{"tags": tags})
+}
+
+// loadOwnTag resolves :id to one of the caller's tags.
+func loadOwnTag(c *gin.Context) (User, Tag, bool) {
+	var tag Tag
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return user, tag, false
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid tag id"})
+		return user, tag, false
+	}
+	if err := DB.Where("id = ? AND owner_id = ?", id, user.ID).First(&tag).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "tag not found"})
+		return user, tag, false
+	}
+	return user, tag, true
+}
+
+// POST /tags/:id/rename  { "name": "invoices" }
+func RenameTagHandler(c *gin.Context) {
+	user, tag, ok := loadOwnTag(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+		return
+	}
+	name, err := cleanTagName(body.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !strings.EqualFold(name, tag.Name) {
+		if err := checkTagUnlocked(DB, tag.Name); err != nil {
+			fileOpFailed(c, err)
+			return
+		}
+		var n int64
+		DB.Model(&Tag{}).Where("owner_id = ? AND lower(name) = lower(?)", user.ID, name).Count(&n)
+		if n > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "a tag with this name already exists; merge the tags instead"})
+			return
+		}
+	}
+	if err := DB.Model(&tag).Update("name", name).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "rename failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tag": tag})
+}
+
+// POST /tags/:id/merge  { "into": 7 }
+//
+// Moves the tag's files to the other tag and deletes it.
+func MergeTagHandler(c *gin.Context) {
+	user, tag, ok := loadOwnTag(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		Into uint `json:"into"`
+	}
+	if err := c.BindJSON(&body); err != nil || body.Into == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "into required"})
+		return
+	}
+	if body.Into == tag.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot merge a tag into itself"})
+		return
+	}
+	var into Tag
+	if err := DB.Where("id = ? AND owner_id = ?", body.Into, user.ID).First(&into).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "target tag not found"})
+		return
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if !strings.EqualFold(tag.Name, into.Name) {
+			if err := checkTagUnlocked(tx, tag.Name); err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec(`INSERT INTO file_tags (file_id, tag_id)
+			SELECT file_id, ? FROM file_tags WHERE tag_id = ?
+			ON CONFLICT DO NOTHING`, into.ID, tag.ID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&tag).Error
+	})
+	if err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "merged", "tag": into})
+}
+
+// DELETE /tags/:id  (removes the tag from every file)
+func DeleteTagHandler(c *gin.Context) {
+	_, tag, ok := loadOwnTag(c)
+	if !ok {
+		return
+	}
+	if err := checkTagUnlocked(DB, tag.Name); err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	if err := DB.Delete(&tag).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// GET /files/:id/tags
+func ListFileTagsHandler(c *gin.Context) {
+	_, file, ok := loadVersionedFile(c)
+	if !ok {
+		return
+	}
+	tags := []Tag{}
+	DB.Model(&file).Order("lower(name)").Association("Tags").Find(&tags)
+	c.JSON(http.StatusOK, gin.H{"file_id": file.ID, "tags": tags})
+}
+
+// loadOwnedFile resolves :id to a file the caller owns, for changing its
+// tags or metadata.
+func loadOwnedFile(c *gin.Context) (File, bool) {
+	user, file, ok := loadVersionedFile(c)
+	if !ok {
+		return file, false
+	}
+	if file.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the owner can change this file"})
+		return file, false
+	}
+	return file, true
+}
+
+// POST /files/:id/tags  { "tags": ["invoice", "2025"] }  adds tags
+// PUT  /files/:id/tags  { "tags": [...] }                replaces them
+func SetFileTagsHandler(c *gin.Context) {
+	file, ok := loadOwnedFile(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+		return
+	}
+	replace := c.Request.Method == http.MethodPut
+	if !replace && len(body.Tags) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tags required"})
+		return
+	}
+	var tags []Tag
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if tags, err = ensureTags(tx, file.UploaderID, body.Tags); err != nil {
+			return err
+		}
+		if !replace {
+			return tx.Model(&file).Association("Tags").Append(tags)
+		}
+		keep := map[string]bool{}
+		for _, t := range tags {
+			keep[strings.ToLower(t.Name)] = true
+		}
+		for _, name := range fileTagNames(tx, file.ID) {
+			if !keep[name] {
+				if err := checkTagUnlocked(tx, name); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Model(&file).Association("Tags").Replace(tags)
+	})
+	if err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	tags = []Tag{}
+	DB.Model(&file).Order("lower(name)").Association("Tags").Find(&tags)
+	c.JSON(http.StatusOK, gin.H{"file_id": file.ID, "tags": tags})
+}
+
+// DELETE /files/:id/tags/:tag  (by name)
+func RemoveFileTagHandler(c *gin.Context) {
+	file, ok := loadOwnedFile(c)
+	if !ok {
+		return
+	}
+	name := c.Param("tag")
+	var tag Tag
+	if err := DB.Where("owner_id = ? AND lower(name) = lower(?)", file.UploaderID, name).First(&tag).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "tag not found"})
+		return
+	}
+	if err := checkTagUnlocked(DB, tag.Name); err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	if err := DB.Model(&file).Association("Tags").Delete(&tag); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "removed"})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// blobGCGrace keeps the GC away from blobs written moments ago whose row may
+// not be committed yet.
+const blobGCGrace = time.Hour
+
+// trashPurgeAt is when the retention job will purge a trashed file, or nil
+// when trash is kept until emptied by hand.
+func trashPurgeAt(file File) *time.Time {
+	if cfg.TrashRetention <= 0 || !file.DeletedAt.Valid {
+		return nil
+	}
+	t := file.DeletedAt.Time.AddDate(0, 0, cfg.TrashRetention)
+	return &t
+}
+
+// findTrashedFile loads a trashed file owned by user.
+func findTrashedFile(c *gin.Context, user User) (File, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return File{}, false
+	}
+	var file File
+	if err := DB.Unscoped().Where("deleted_at IS NOT NULL").First(&file, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not in trash"})
+		return File{}, false
+	}
+	if file.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only uploader can manage trashed file"})
+		return File{}, false
+	}
+	return file, true
+}
+
+// releaseBlobs rechecks the blobs of purged rows, removing unreferenced ones.
+func releaseBlobs(files []File) {
+	seen := map[string]bool{}
+	for _, f := range files {
+		if seen[f.Hash] {
+			continue
+		}
+		seen[f.Hash] = true
+		syncBlobRefCount(DB, f.Hash, f.Path)
+	}
+}
+
+// purgeFiles removes trashed rows for good, with their version history, and
+// frees their blobs.
+func purgeFiles(files []File) error {
+	if len(files) == 0 {
+		return nil
+	}
+	ids := make([]uint, 0, len(files))
+	for _, f := range files {
+		ids = append(ids, f.ID)
+	}
+	var versions []FileVersion
+	DB.Where("file_id IN ?", ids).Find(&versions)
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("file_id IN ?", ids).Delete(&FileVersion{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("id IN ?", ids).Delete(&File{}).Error
+	})
+	if err != nil {
+		return err
+	}
+	releaseBlobs(files)
+	releaseVersionBlobs(versions)
+	return nil
+}
+
+// GET /trash
+func ListTrashHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	var files []File
+	DB.Unscoped().Where("uploader_id = ? AND deleted_at IS NOT NULL", user.ID).Order("deleted_at DESC").Find(&files)
+
+	entries := make([]gin.H, 0, len(files))
+	for _, f := range files {
+		entries = append(entries, gin.H{"file": f, "deleted_at": f.DeletedAt.Time, "purge_at": trashPurgeAt(f)})
+	}
+	c.JSON(http.StatusOK, gin.H{"retention_days": cfg.TrashRetention, "trash": entries})
+}
+
+// POST /trash/:id/restore
+func RestoreFileHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	file, ok := findTrashedFile(c, user)
+	if !ok {
+		return
+	}
+
+	// back into the original folder, or the root if that folder is gone
+	folderID := file.FolderID
+	if folderID != nil {
+		var folder Folder
+		if err := DB.First(&folder, *folderID).Error; err != nil {
+			folderID = nil
+		}
+	}
+	name := freeName(DB, file.UploaderID, folderID, file.Filename)
+	if err := DB.Unscoped().Model(&file).Updates(map[string]interface{}{
+		"deleted_at": nil,
+		"folder_id":  folderID,
+		"filename":   name,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "restore failed"})
+		return
+	}
+	DB.First(&file, file.ID)
+	c.JSON(http.StatusOK, gin.H{"status": "restored", "file": file})
+}
+
+// DELETE /trash/:id
+func PurgeFileHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	file, ok := findTrashedFile(c, user)
+	if !ok {
+		return
+	}
+	if err := checkFileDeletable(file); err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	if err := purgeFileRecord(file); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "purge failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "purged"})
+}
+
+// DELETE /trash
+func EmptyTrashHandler(c *gin.Context) {
+	username := c.GetHeader("X-User")
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	var files []File
+	DB.Unscoped().Where("uploader_id = ? AND deleted_at IS NOT NULL", user.ID).Find(&files)
+	files, kept := purgeable(files)
+	if err := purgeFiles(files); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "purge failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "purged", "count": len(files), "kept": len(kept)})
+}
+
+// runTrashJanitor moves files past their retention rule's maximum age to the
+// trash, purges trash older than TRASH_RETENTION_DAYS and then removes blobs
+// no row references any more, once at startup and hourly after.
+func runTrashJanitor() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		expireRetainedFiles()
+		purgeExpiredTrash()
+		collectOrphanBlobs()
+		pruneSignedURLUses()
+		<-ticker.C
+	}
+}
+
+func purgeExpiredTrash() {
+	if cfg.TrashRetention <= 0 {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -cfg.TrashRetention)
+	var files []File
+	if err := DB.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).Find(&files).Error; err != nil {
+		log.Printf("trash purge failed: %v", err)
+		return
+	}
+	files, _ = purgeable(files)
+	if err := purgeFiles(files); err != nil {
+		log.Printf("trash purge failed: %v", err)
+		return
+	}
+	if len(files) > 0 {
+		log.Printf("purged %d files from trash", len(files))
+	}
+}
+
+// blobNamePattern matches the names storeBlob gives blobs: the content hash
+// plus the extension of its MIME type.
+var blobNamePattern = regexp.MustCompile(`^[0-9a-f]{64}(\.[A-Za-z0-9]+)?$`)
+
+// collectOrphanBlobs deletes blobs in the upload directory that no row
+// points at, such as ones left behind by a crash between store and insert.
+// Files not named like a blob are never touched.
+func collectOrphanBlobs() {
+	var paths, versionPaths []string
+	if err := DB.Unscoped().Model(&File{}).Distinct().Pluck("path", &paths).Error; err != nil {
+		log.Printf("blob gc skipped: %v", err)
+		return
+	}
+	if err := DB.Model(&FileVersion{}).Distinct().Pluck("path", &versionPaths).Error; err != nil {
+		log.Printf("blob gc skipped: %v", err)
+		return
+	}
+	referenced := make(map[string]bool, len(paths)+len(versionPaths))
+	for _, p := range append(paths, versionPaths...) {
+		referenced[p] = true
+	}
+
+	entries, err := os.ReadDir(cfg.UploadPath)
+	if err != nil {
+		log.Printf("blob gc skipped: %v", err)
+		return
+	}
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() || !blobNamePattern.MatchString(e.Name()) || referenced[e.Name()] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < blobGCGrace {
+			continue
+		}
+		if os.Remove(filepath.Join(cfg.UploadPath, e.Name())) == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("blob gc removed %d unreferenced blobs", removed)
+	}
+}
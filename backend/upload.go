@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -33,6 +34,7 @@ func mimeMatches(declared, detected string) bool {
 
 	equivs := map[string][]string{
 		"application/octet-stream": {"application/zip", "application/x-zip-compressed"},
+		docxMime:                   {"application/zip"},
 	}
 	if arr, ok := equivs[decl]; ok {
 		for _, v := range arr {
@@ -50,8 +52,7 @@ func mimeMatches(declared, detected string) bool {
 	return false
 }
 
-func validateDeclaredMime(fh *multipart.FileHeader, tmpFilePath string) (bool, string, string, error) {
-	declared := fh.Header.Get("Content-Type")
+func validateDeclaredMime(declared, tmpFilePath string) (bool, string, string, error) {
 	detected, err := detectMimeType(tmpFilePath)
 	if err != nil {
 		return false, declared, "", err
@@ -60,6 +61,255 @@ func validateDeclaredMime(fh *multipart.FileHeader, tmpFilePath string) (bool, s
 	return ok, declared, detected, nil
 }
 
+// mimeMismatchError is returned by storeBlob when the declared content type
+// does not match the detected one.
+type mimeMismatchError struct {
+	Declared string
+	Detected string
+}
+
+func (e *mimeMismatchError) Error() string {
+	return fmt.Sprintf("MIME mismatch: declared %s, detected %s", e.Declared, e.Detected)
+}
+
+// storedBlob is the content-addressed blob behind one or more File rows.
+type storedBlob struct {
+	Hash        string
+	Path        string
+	ContentType string
+	Size        int64
+	Deduped     bool
+}
+
+// storeBlob validates the MIME type of the file saved at tmp, hashes it and
+// moves it into the upload directory unless a blob with the same hash is
+// already stored. tmp is always consumed.
+func storeBlob(tmp, declared string) (storedBlob, error) {
+	defer os.Remove(tmp)
+
+	// MIME validation
+	ok, declared, detected, err := validateDeclaredMime(declared, tmp)
+	if err != nil {
+		return storedBlob{}, fmt.Errorf("mime detect error: %v", err)
+	}
+	if !ok {
+		return storedBlob{}, &mimeMismatchError{Declared: declared, Detected: detected}
+	}
+
+	// Compute hash
+	f, err := os.Open(tmp)
+	if err != nil {
+		return storedBlob{}, fmt.Errorf("hash error: %v", err)
+	}
+	h, err := hashFile(f)
+	info, statErr := f.Stat()
+	f.Close()
+	if err != nil {
+		return storedBlob{}, fmt.Errorf("hash error: %v", err)
+	}
+	if statErr != nil {
+		return storedBlob{}, fmt.Errorf("stat error: %v", statErr)
+	}
+	blob := storedBlob{Hash: h, ContentType: detected, Size: info.Size()}
+
+	// Dedup check (blobs of trashed files are still on disk)
+	var existing File
+	result := DB.Unscoped().Where("hash = ?", h).Take(&existing)
+	if result.Error == nil {
+		if _, err := os.Stat(filepath.Join(cfg.UploadPath, existing.Path)); err == nil {
+			blob.Path = existing.Path
+			blob.Deduped = true
+			return blob, nil
+		}
+		// the row survived but its blob did not; store this copy in its place
+	} else if result.Error != gorm.ErrRecordNotFound {
+		return storedBlob{}, fmt.Errorf("db error")
+	}
+
+	// New blob: move to uploads directory with hash+ext
+	if err := ensureUploadPath(); err != nil {
+		return storedBlob{}, fmt.Errorf("cannot create upload path")
+	}
+	blob.Path = h + getExtFromMime(detected)
+	if result.Error == nil {
+		blob.Path = existing.Path
+	}
+	destPath := filepath.Join(cfg.UploadPath, blob.Path)
+	if err := os.Rename(tmp, destPath); err != nil {
+		in, err := os.Open(tmp)
+		if err != nil {
+			return storedBlob{}, fmt.Errorf("store failed: %v", err)
+		}
+		out, err := os.Create(destPath)
+		if err != nil {
+			in.Close()
+			return storedBlob{}, fmt.Errorf("store failed: %v", err)
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		out.Close()
+		if err != nil {
+			os.Remove(destPath)
+			return storedBlob{}, fmt.Errorf("store failed: %v", err)
+		}
+	}
+	return blob, nil
+}
+
+// syncBlobRefCount recounts the rows sharing a blob: files, trashed ones
+// included, and stored versions. Every file row carries the count in
+// ref_count; once nothing references the blob it is removed from disk.
+func syncBlobRefCount(db *gorm.DB, hash, path string) {
+	var files, versions int64
+	db.Unscoped().Model(&File{}).Where("hash = ?", hash).Count(&files)
+	db.Model(&FileVersion{}).Where("hash = ?", hash).Count(&versions)
+	count := files + versions
+	if count == 0 {
+		os.Remove(filepath.Join(cfg.UploadPath, path))
+		db.Where("hash = ?", hash).Delete(&BlobText{})
+		return
+	}
+	db.Unscoped().Model(&File{}).Where("hash = ?", hash).Update("ref_count", count)
+}
+
+// createFileRecord adds the metadata row for a stored blob.
+func createFileRecord(user User, blob storedBlob, filename string, folderID *uint) (File, error) {
+	fmeta := File{
+		Filename:    filename,
+		ContentType: blob.ContentType,
+		Size:        blob.Size,
+		Hash:        blob.Hash,
+		Path:        blob.Path,
+		UploaderID:  user.ID,
+		FolderID:    folderID,
+		RefCount:    1,
+		Extracted:   extractEmbeddedMetadata(filepath.Join(cfg.UploadPath, blob.Path), blob.ContentType),
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&fmeta).Error; err != nil {
+			return err
+		}
+		syncBlobRefCount(tx, blob.Hash, blob.Path)
+		return nil
+	})
+	if err != nil {
+		if !blob.Deduped {
+			syncBlobRefCount(DB, blob.Hash, blob.Path)
+		}
+		return File{}, fmt.Errorf("db create failed")
+	}
+	notifyUpload(fmeta.ID, fmeta.Filename)
+	indexFileAsync(fmeta)
+	return fmeta, nil
+}
+
+// addFileVersion makes blob the newest version of file. The previous
+// content stays available as an older version until the retention policy
+// prunes it. Uploading the current content again changes nothing.
+func addFileVersion(file File, blob storedBlob, uploader User) (File, error) {
+	if blob.Hash == file.Hash {
+		return file, nil
+	}
+	if file.LegalHold {
+		if !blob.Deduped {
+			syncBlobRefCount(DB, blob.Hash, blob.Path)
+		}
+		return file, opError(http.StatusLocked, "file is under legal hold")
+	}
+	extracted := extractEmbeddedMetadata(filepath.Join(cfg.UploadPath, blob.Path), blob.ContentType)
+	var pruned []FileVersion
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := ensureVersionHistory(tx, file); err != nil {
+			return err
+		}
+		var latest int
+		tx.Model(&FileVersion{}).Where("file_id = ?", file.ID).Select("COALESCE(MAX(version),0)").Scan(&latest)
+		v := FileVersion{
+			FileID:      file.ID,
+			Version:     latest + 1,
+			Hash:        blob.Hash,
+			Path:        blob.Path,
+			Size:        blob.Size,
+			ContentType: blob.ContentType,
+			UploaderID:  uploader.ID,
+		}
+		if err := tx.Create(&v).Error; err != nil {
+			return err
+		}
+
+		file.Hash = blob.Hash
+		file.Path = blob.Path
+		file.Size = blob.Size
+		file.ContentType = blob.ContentType
+		file.Version = v.Version
+		file.Extracted = extracted
+		if err := tx.Model(&file).Updates(map[string]interface{}{
+			"hash":         file.Hash,
+			"path":         file.Path,
+			"size":         file.Size,
+			"content_type": file.ContentType,
+			"version":      file.Version,
+			"extracted":    file.Extracted,
+		}).Error; err != nil {
+			return err
+		}
+
+		var err error
+		if pruned, err = pruneVersions(tx, file); err != nil {
+			return err
+		}
+		syncBlobRefCount(tx, blob.Hash, blob.Path)
+		return nil
+	})
+	if err != nil {
+		if !blob.Deduped {
+			syncBlobRefCount(DB, blob.Hash, blob.Path)
+		}
+		return File{}, fmt.Errorf("db update failed")
+	}
+	releaseVersionBlobs(pruned)
+	notifyUpload(file.ID, file.Filename)
+	indexFileAsync(file)
+	return file, nil
+}
+
+// ingestUpload runs a file saved at tmp through the same pipeline as
+// UploadHandler (MIME validation, hashing, dedup) and records it for the user.
+// It returns "uploaded" or "deduped" as status.
+func ingestUpload(user User, tmp, filename, declared string, folderID *uint) (File, string, error) {
+	blob, err := storeBlob(tmp, declared)
+	if err != nil {
+		return File{}, "", err
+	}
+	fmeta, err := createFileRecord(user, blob, filename, folderID)
+	if err != nil {
+		return File{}, "", err
+	}
+	if blob.Deduped {
+		return fmeta, "deduped", nil
+	}
+	return fmeta, "uploaded", nil
+}
+
+// ingestVersion runs a file saved at tmp through the same pipeline and makes
+// it the newest version of file. It returns "replaced" as status.
+func ingestVersion(user User, file File, tmp, declared string) (File, string, error) {
+	blob, err := storeBlob(tmp, declared)
+	if err != nil {
+		return File{}, "", err
+	}
+	updated, err := addFileVersion(file, blob, user)
+	if err != nil {
+		return File{}, "", err
+	}
+	return updated, "replaced", nil
+}
+
+// tempUploadPath returns a unique temp file path for an incoming upload.
+func tempUploadPath(filename string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%d_%s", time.Now().UnixNano(), sanitizeFilename(filename)))
+}
+
 func UploadHandler(c *gin.Context) {
 	username := c.GetHeader("X-User")
 	if username == "" {
@@ -99,108 +349,36 @@ func UploadHandler(c *gin.Context) {
 	results := make([]gin.H, 0, len(fhs))
 
 	for _, fh := range fhs {
-		tmp := filepath.Join(os.TempDir(), fmt.Sprintf("%d_%s", time.Now().UnixNano(), sanitizeFilename(fh.Filename)))
+		tmp := tempUploadPath(fh.Filename)
 		if err := c.SaveUploadedFile(fh, tmp); err != nil {
 			results = append(results, gin.H{"filename": fh.Filename, "error": fmt.Sprintf("save temp failed: %v", err)})
 			continue
 		}
 
-		// MIME validation
-		ok, declared, detected, err := validateDeclaredMime(fh, tmp)
-		if err != nil {
-			os.Remove(tmp)
-			results = append(results, gin.H{"filename": fh.Filename, "error": fmt.Sprintf("mime detect error: %v", err)})
-			continue
+		// a file with the same name gets a new version instead of a twin
+		var fmeta File
+		var status string
+		if existing, ok := findFolderFile(user.ID, nil, fh.Filename); ok {
+			fmeta, status, err = ingestVersion(user, existing, tmp, fh.Header.Get("Content-Type"))
+		} else {
+			fmeta, status, err = ingestUpload(user, tmp, fh.Filename, fh.Header.Get("Content-Type"), nil)
 		}
-		if !ok {
-			os.Remove(tmp)
+		var mismatch *mimeMismatchError
+		if errors.As(err, &mismatch) {
 			results = append(results, gin.H{
 				"filename": fh.Filename,
 				"status":   "rejected",
 				"reason":   "MIME mismatch",
-				"declared": declared,
-				"detected": detected,
+				"declared": mismatch.Declared,
+				"detected": mismatch.Detected,
 			})
 			continue
 		}
-
-		// Compute hash
-		f, _ := os.Open(tmp)
-		h, err := hashFile(f)
-		f.Close()
 		if err != nil {
-			os.Remove(tmp)
-			results = append(results, gin.H{"filename": fh.Filename, "error": fmt.Sprintf("hash error: %v", err)})
-			continue
-		}
-
-		// Dedup check
-		var existing File
-		result := DB.Where("hash = ?", h).Take(&existing)
-		if result.Error == nil {
-			tx := DB.Begin()
-			if err := tx.Model(&File{}).Where("hash = ?", h).
-				UpdateColumn("ref_count", gorm.Expr("ref_count + ?", 1)).Error; err != nil {
-				tx.Rollback()
-				os.Remove(tmp)
-				results = append(results, gin.H{"filename": fh.Filename, "error": "db update error"})
-				continue
-			}
-			fmeta := File{
-				Filename:    fh.Filename,
-				ContentType: detectedMimeOrHeader(fh),
-				Size:        fh.Size,
-				Hash:        h,
-				Path:        existing.Path,
-				UploaderID:  user.ID,
-				RefCount:    1,
-			}
-			if err := tx.Create(&fmeta).Error; err != nil {
-				tx.Rollback()
-				os.Remove(tmp)
-				results = append(results, gin.H{"filename": fh.Filename, "error": "db create failed"})
-				continue
-			}
-			tx.Commit()
-			os.Remove(tmp)
-			results = append(results, gin.H{"filename": fh.Filename, "status": "deduped"})
-			continue
-		} else if result.Error != nil && result.Error != gorm.ErrRecordNotFound {
-			os.Remove(tmp)
-			results = append(results, gin.H{"filename": fh.Filename, "error": "db error"})
+			results = append(results, gin.H{"filename": fh.Filename, "error": err.Error()})
 			continue
 		}
-
-		// New blob: move to uploads directory with hash+ext
-		mimeType, _ := detectMimeType(tmp)
-		ext := getExtFromMime(mimeType)
-		destName := h + ext
-		destPath := filepath.Join(cfg.UploadPath, destName)
-		if err := os.Rename(tmp, destPath); err != nil {
-			in, _ := os.Open(tmp)
-			out, _ := os.Create(destPath)
-			_, _ = io.Copy(out, in)
-			in.Close()
-			out.Close()
-			os.Remove(tmp)
-		}
-
-		// create metadata row
-		fmeta := File{
-			Filename:    fh.Filename,
-			ContentType: mimeType,
-			Size:        fh.Size,
-			Hash:        h,
-			Path:        destName,
-			UploaderID:  user.ID,
-			RefCount:    1,
-		}
-		if err := DB.Create(&fmeta).Error; err != nil {
-			os.Remove(destPath)
-			results = append(results, gin.H{"filename": fh.Filename, "error": "db create failed"})
-			continue
-		}
-		results = append(results, gin.H{"filename": fh.Filename, "status": "uploaded", "file_id": fmeta.ID})
+		results = append(results, gin.H{"filename": fh.Filename, "status": status, "file_id": fmeta.ID, "version": fmeta.Version})
 	}
 
 	c.JSON(http.StatusOK, gin.H{"results": results})
@@ -209,13 +387,3 @@ func UploadHandler(c *gin.Context) {
 func sanitizeFilename(name string) string {
 	return strings.ReplaceAll(filepath.Base(name), string(os.PathSeparator), "_")
 }
-
-func detectedMimeOrHeader(fh *multipart.FileHeader) string {
-	if detected, err := detectMimeType(filepath.Join(os.TempDir(), fh.Filename)); err == nil && detected != "" {
-		return detected
-	}
-	if h := fh.Header.Get("Content-Type"); h != "" {
-		return h
-	}
-	return "application/octet-stream"
-}
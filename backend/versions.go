@@ -0,0 +1,281 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// currentVersion describes the file's current content as a version. Files
+// that never got a second version have no history rows yet.
+func currentVersion(file File) FileVersion {
+	return FileVersion{
+		FileID:      file.ID,
+		Version:     file.Version,
+		Hash:        file.Hash,
+		Path:        file.Path,
+		Size:        file.Size,
+		ContentType: file.ContentType,
+		UploaderID:  file.UploaderID,
+		CreatedAt:   file.CreatedAt,
+	}
+}
+
+// ensureVersionHistory records the file's current content as its first
+// version before another one is added.
+func ensureVersionHistory(tx *gorm.DB, file File) error {
+	var count int64
+	tx.Model(&FileVersion{}).Where("file_id = ?", file.ID).Count(&count)
+	if count > 0 {
+		return nil
+	}
+	v := currentVersion(file)
+	return tx.Create(&v).Error
+}
+
+// versionLimit is how many versions of the file are kept (0 keeps all).
+func versionLimit(file File) int {
+	if file.MaxVersions != nil {
+		return *file.MaxVersions
+	}
+	return cfg.MaxFileVersions
+}
+
+// pruneVersions drops the oldest versions beyond the file's limit and
+// returns them so their blobs can be released after the transaction. The
+// history of a file on legal hold is kept whole.
+func pruneVersions(tx *gorm.DB, file File) ([]FileVersion, error) {
+	limit := versionLimit(file)
+	if limit <= 0 || file.LegalHold {
+		return nil, nil
+	}
+	var old []FileVersion
+	tx.Where("file_id = ?", file.ID).Order("version DESC").Offset(limit).Find(&old)
+	if len(old) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint, 0, len(old))
+	for _, v := range old {
+		ids = append(ids, v.ID)
+	}
+	if err := tx.Where("id IN ?", ids).Delete(&FileVersion{}).Error; err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// releaseVersionBlobs rechecks the blobs of removed versions.
+func releaseVersionBlobs(versions []FileVersion) {
+	files := make([]File, 0, len(versions))
+	for _, v := range versions {
+		files = append(files, File{Hash: v.Hash, Path: v.Path})
+	}
+	releaseBlobs(files)
+}
+
+// findFileVersion loads version n of the file.
+func findFileVersion(file File, n int) (FileVersion, bool) {
+	var v FileVersion
+	if err := DB.Preload("Uploader").Where("file_id = ? AND version = ?", file.ID, n).First(&v).Error; err == nil {
+		return v, true
+	}
+	if n == file.Version {
+		v = currentVersion(file)
+		DB.First(&v.Uploader, v.UploaderID)
+		return v, true
+	}
+	return FileVersion{}, false
+}
+
+// loadVersionedFile reads :id and, when given, :version, answering the
+// request itself on failure.
+func loadVersionedFile(c *gin.Context) (User, File, bool) {
+	user, err := getUserFromHeader(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-User header required"})
+		return User{}, File{}, false
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return User{}, File{}, false
+	}
+	var file File
+	if err := DB.First(&file, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return User{}, File{}, false
+	}
+	if !userHasAccessToFile(user, file) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you do not have access to this file"})
+		return User{}, File{}, false
+	}
+	return user, file, true
+}
+
+func versionParam(c *gin.Context, file File) (FileVersion, bool) {
+	n, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return FileVersion{}, false
+	}
+	v, ok := findFileVersion(file, n)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+		return FileVersion{}, false
+	}
+	return v, true
+}
+
+// GET /files/:id/versions
+func ListFileVersionsHandler(c *gin.Context) {
+	_, file, ok := loadVersionedFile(c)
+	if !ok {
+		return
+	}
+	var versions []FileVersion
+	DB.Preload("Uploader").Where("file_id = ?", file.ID).Order("version DESC").Find(&versions)
+	if len(versions) == 0 {
+		v, _ := findFileVersion(file, file.Version)
+		versions = []FileVersion{v}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"file_id":         file.ID,
+		"current_version": file.Version,
+		"max_versions":    versionLimit(file),
+		"versions":        versions,
+	})
+}
+
+// POST /files/:id/versions  (multipart, field "file")
+func UploadFileVersionHandler(c *gin.Context) {
+	user, file, ok := loadVersionedFile(c)
+	if !ok {
+		return
+	}
+	if file.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only uploader can add versions"})
+		return
+	}
+	fh, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no file provided (use field name 'file')"})
+		return
+	}
+	tmp := tempUploadPath(fh.Filename)
+	if err := c.SaveUploadedFile(fh, tmp); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "save temp failed"})
+		return
+	}
+	blob, err := storeBlob(tmp, fh.Header.Get("Content-Type"))
+	if err != nil {
+		uploadError(c, err)
+		return
+	}
+	previous := file.Version
+	updated, err := addFileVersion(file, blob, user)
+	if err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	if updated.Version == previous {
+		c.JSON(http.StatusOK, gin.H{"status": "unchanged", "file": updated})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"status": "versioned", "file": updated})
+}
+
+// GET /files/:id/versions/:version/download
+func DownloadFileVersionHandler(c *gin.Context) {
+	_, file, ok := loadVersionedFile(c)
+	if !ok {
+		return
+	}
+	v, ok := versionParam(c, file)
+	if !ok {
+		return
+	}
+	fullPath := filepath.Join(cfg.UploadPath, v.Path)
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "file missing"})
+		return
+	}
+	if err := DB.Model(&file).UpdateColumn("download_count", gorm.Expr("download_count + 1")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update download count"})
+		return
+	}
+	notifyDownload(file.ID, file.DownloadCount+1)
+	c.FileAttachment(fullPath, file.Filename)
+}
+
+// POST /files/:id/versions/:version/restore
+//
+// Restoring adds the old content as a new version, so nothing is lost.
+func RestoreFileVersionHandler(c *gin.Context) {
+	user, file, ok := loadVersionedFile(c)
+	if !ok {
+		return
+	}
+	if file.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only uploader can restore versions"})
+		return
+	}
+	v, ok := versionParam(c, file)
+	if !ok {
+		return
+	}
+	if v.Version == file.Version {
+		c.JSON(http.StatusOK, gin.H{"status": "unchanged", "file": file})
+		return
+	}
+	blob := storedBlob{Hash: v.Hash, Path: v.Path, ContentType: v.ContentType, Size: v.Size, Deduped: true}
+	updated, err := addFileVersion(file, blob, user)
+	if err != nil {
+		fileOpFailed(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "restored", "restored_from": v.Version, "file": updated})
+}
+
+// POST /files/:id/versions/policy  { "max_versions": 5 }  (null falls back to MAX_FILE_VERSIONS)
+func SetVersionPolicyHandler(c *gin.Context) {
+	user, file, ok := loadVersionedFile(c)
+	if !ok {
+		return
+	}
+	if file.UploaderID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only uploader can change the version policy"})
+		return
+	}
+	var body struct {
+		MaxVersions *int `json:"max_versions"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"})
+		return
+	}
+	if body.MaxVersions != nil && *body.MaxVersions < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_versions must be 0 (keep all) or more"})
+		return
+	}
+
+	file.MaxVersions = body.MaxVersions
+	var pruned []FileVersion
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&file).Update("max_versions", body.MaxVersions).Error; err != nil {
+			return err
+		}
+		var err error
+		pruned, err = pruneVersions(tx, file)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"})
+		return
+	}
+	releaseVersionBlobs(pruned)
+	c.JSON(http.StatusOK, gin.H{"file_id": file.ID, "max_versions": versionLimit(file), "pruned": len(pruned)})
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/webdav"
+)
+
+// davSharedDir is the virtual top-level folder holding everything shared
+// with the user. It is read-only.
+const davSharedDir = "Shared with me"
+
+// davMethods are the WebDAV verbs gin needs explicit routes for, on top of
+// the usual HTTP ones.
+var davMethods = []string{
+	"GET", "HEAD", "PUT", "DELETE", "OPTIONS",
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+var errDavIsDir = errors.New("is a directory")
+
+type davUserKey struct{}
+
+func davUser(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(davUserKey{}).(User)
+	return user, ok
+}
+
+// WebDAVHandler serves the user's vault over WebDAV at /webdav/. Desktop
+// clients cannot send X-User, so Basic auth is accepted as well, checked
+// against WEBDAV_PASSWORD; without one configured Basic auth is refused.
+func WebDAVHandler() gin.HandlerFunc {
+	h := &webdav.Handler{
+		Prefix:     "/webdav",
+		FileSystem: davFS{},
+		LockSystem: webdav.NewMemLS(),
+	}
+	return func(c *gin.Context) {
+		username := c.GetHeader("X-User")
+		if username == "" {
+			u, password, ok := c.Request.BasicAuth()
+			if !ok || cfg.WebDAVPassword == "" ||
+				subtle.ConstantTimeCompare([]byte(password), []byte(cfg.WebDAVPassword)) != 1 {
+				c.Header("WWW-Authenticate", `Basic realm="File Vault"`)
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			username = u
+		}
+		var user User
+		if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+			c.Header("WWW-Authenticate", `Basic realm="File Vault"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(c.Request.Context(), davUserKey{}, user)
+		h.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+	}
+}
+
+// davFileInfo describes a vault folder or file to the WebDAV handler.
+type davFileInfo struct {
+	name        string
+	size        int64
+	dir         bool
+	modTime     time.Time
+	contentType string
+	hash        string
+}
+
+func (fi davFileInfo) Name() string       { return fi.name }
+func (fi davFileInfo) Size() int64        { return fi.size }
+func (fi davFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi davFileInfo) IsDir() bool        { return fi.dir }
+func (fi davFileInfo) Sys() interface{}   { return nil }
+
+func (fi davFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType saves the handler from opening the blob to sniff it.
+func (fi davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.contentType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.contentType, nil
+}
+
+// ETag uses the content hash, so it only changes when the content does.
+func (fi davFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.hash == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.hash + `"`, nil
+}
+
+// davNode is a resolved WebDAV path: a vault node, optionally inside the
+// read-only shared tree.
+type davNode struct {
+	vaultNode
+	shared     bool // anywhere below davSharedDir
+	sharedRoot bool // davSharedDir itself
+}
+
+func (n davNode) info() davFileInfo {
+	switch {
+	case n.sharedRoot:
+		return davFileInfo{name: davSharedDir, dir: true, modTime: time.Unix(0, 0)}
+	case n.File != nil:
+		return davFileInfo{
+			name:        n.File.Filename,
+			size:        n.File.Size,
+			modTime:     n.File.CreatedAt,
+			contentType: n.File.ContentType,
+			hash:        n.File.Hash,
+		}
+	case n.Folder != nil:
+		return davFileInfo{name: n.Folder.Name, dir: true, modTime: n.Folder.CreatedAt}
+	}
+	return davFileInfo{name: "/", dir: true, modTime: time.Unix(0, 0)}
+}
+
+// sharedWithUser returns the folders and files other users shared with user.
+func sharedWithUser(user User) ([]Folder, []File) {
+	var folders []Folder
+	var files []File
+	DB.Joins("JOIN shared_folder_access s ON s.folder_id = folders.id").
+		Where("s.target_user_id = ?", user.ID).Order("folders.name").Find(&folders)
+	DB.Joins("JOIN shared_file_access s ON s.file_id = files.id").
+		Where("s.target_user_id = ?", user.ID).Order("files.filename").Find(&files)
+	return folders, files
+}
+
+// resolveShared walks the shared tree. The first segment is a folder or file
+// shared with the user; below a shared folder every child is visible.
+func resolveShared(user User, segments []string) (davNode, error) {
+	if len(segments) == 0 {
+		return davNode{shared: true, sharedRoot: true}, nil
+	}
+	folders, files := sharedWithUser(user)
+	var node vaultNode
+	found := false
+	for i := range folders {
+		if folders[i].Name == segments[0] {
+			node, found = vaultNode{Folder: &folders[i]}, true
+			break
+		}
+	}
+	if !found {
+		for i := range files {
+			if files[i].Filename == segments[0] {
+				node, found = vaultNode{File: &files[i]}, true
+				break
+			}
+		}
+	}
+	if !found {
+		return davNode{}, os.ErrNotExist
+	}
+
+	for i, name := range segments[1:] {
+		if node.File != nil {
+			return davNode{}, os.ErrNotExist
+		}
+		var folder Folder
+		if err := DB.Where("parent_id = ? AND name = ?", node.Folder.ID, name).First(&folder).Error; err == nil {
+			node = vaultNode{Folder: &folder}
+			continue
+		}
+		var file File
+		if i == len(segments)-2 {
+			if err := DB.Where("folder_id = ? AND filename = ?", node.Folder.ID, name).Order("id DESC").First(&file).Error; err == nil {
+				node = vaultNode{File: &file}
+				continue
+			}
+		}
+		return davNode{}, os.ErrNotExist
+	}
+	return davNode{vaultNode: node, shared: true}, nil
+}
+
+// resolveMountPath resolves a path as seen by WebDAV and SFTP clients: the
+// user's own tree, with the shared tree mounted under davSharedDir.
+func resolveMountPath(user User, name string) (davNode, error) {
+	segments, err := splitVaultPath(name)
+	if err != nil {
+		return davNode{}, os.ErrInvalid
+	}
+	if len(segments) > 0 && segments[0] == davSharedDir {
+		return resolveShared(user, segments[1:])
+	}
+	node, err := resolveVaultPath(user, segments)
+	if err != nil {
+		return davNode{}, os.ErrNotExist
+	}
+	return davNode{vaultNode: node}, nil
+}
+
+// resolveMountParent resolves the folder that would contain name and returns
+// it with the final path segment. Only the user's own tree is writable.
+func resolveMountParent(user User, name string) (*uint, string, error) {
+	name = strings.TrimRight(name, "/")
+	dir, base := path.Dir(name), path.Base(name)
+	parent, err := resolveMountPath(user, dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if parent.shared || parent.File != nil {
+		return nil, "", os.ErrPermission
+	}
+	if !validFolderName(base) || (parent.isRoot() && base == davSharedDir) {
+		return nil, "", os.ErrInvalid
+	}
+	return parent.folderID(), base, nil
+}
+
+// davFS maps the vault onto webdav.FileSystem for the user in the context.
+type davFS struct{}
+
+func (davFS) resolve(ctx context.Context, name string) (User, davNode, error) {
+	user, ok := davUser(ctx)
+	if !ok {
+		return User{}, davNode{}, os.ErrPermission
+	}
+	node, err := resolveMountPath(user, name)
+	return user, node, err
+}
+
+func (davFS) resolveParent(ctx context.Context, name string) (User, *uint, string, error) {
+	user, ok := davUser(ctx)
+	if !ok {
+		return User{}, nil, "", os.ErrPermission
+	}
+	parentID, base, err := resolveMountParent(user, name)
+	return user, parentID, base, err
+}
+
+func (fs davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	_, node, err := fs.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(), nil
+}
+
+func (fs davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	user, ok := davUser(ctx)
+	if !ok {
+		return os.ErrPermission
+	}
+	return mkdirMountPath(user, name)
+}
+
+func (fs davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return fs.openForWrite(ctx, name, flag)
+	}
+
+	user, node, err := fs.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if node.File == nil {
+		return &davDir{user: user, node: node}, nil
+	}
+	f, err := os.Open(filepath.Join(cfg.UploadPath, node.File.Path))
+	if err != nil {
+		return nil, err
+	}
+	return &davReader{File: f, info: node.info()}, nil
+}
+
+func (fs davFS) openForWrite(ctx context.Context, name string, flag int) (webdav.File, error) {
+	user, parentID, base, err := fs.resolveParent(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := findChildFolder(user.ID, parentID, base); ok {
+		return nil, errDavIsDir
+	}
+	existing, exists := findFolderFile(user.ID, parentID, base)
+	if !exists && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	if exists && existing.LegalHold {
+		return nil, os.ErrPermission
+	}
+	tmp, err := os.Create(tempUploadPath(base))
+	if err != nil {
+		return nil, err
+	}
+	w := &davWriter{tmp: tmp, user: user, folderID: parentID, name: base}
+	if exists {
+		w.existing = &existing
+	}
+	return w, nil
+}
+
+func (fs davFS) RemoveAll(ctx context.Context, name string) error {
+	user, ok := davUser(ctx)
+	if !ok {
+		return os.ErrPermission
+	}
+	// WebDAV DELETE on a collection removes everything below it
+	return removeMountPath(user, name, true)
+}
+
+func (fs davFS) Rename(ctx context.Context, oldName, newName string) error {
+	user, ok := davUser(ctx)
+	if !ok {
+		return os.ErrPermission
+	}
+	return renameMountPath(user, oldName, newName)
+}
+
+// mkdirMountPath creates a single folder; its parent must already exist.
+func mkdirMountPath(user User, name string) error {
+	parentID, base, err := resolveMountParent(user, name)
+	if err != nil {
+		return err
+	}
+	if _, ok := findChildFolder(user.ID, parentID, base); ok {
+		return os.ErrExist
+	}
+	if _, ok := findFolderFile(user.ID, parentID, base); ok {
+		return os.ErrExist
+	}
+	return DB.Create(&Folder{Name: base, ParentID: parentID, UploaderID: user.ID}).Error
+}
+
+// removeMountPath deletes a file or a folder from the user's own tree. Unless
+// recursive is set, folders must be empty.
+func removeMountPath(user User, name string, recursive bool) error {
+	node, err := resolveMountPath(user, name)
+	if err != nil {
+		return err
+	}
+	if node.shared || node.isRoot() {
+		return os.ErrPermission
+	}
+	if node.File != nil {
+		err = deleteFileRecord(*node.File)
+	} else {
+		mode := ""
+		if recursive {
+			mode = folderDeleteRecursive
+		}
+		_, err = deleteFolderNow(*node.Folder, mode)
+	}
+	if _, ok := err.(*fileOpError); ok {
+		return os.ErrPermission
+	}
+	return err
+}
+
+// renameMountPath moves and/or renames a file or folder within the user's
+// own tree. The target name must be free.
+func renameMountPath(user User, oldName, newName string) error {
+	node, err := resolveMountPath(user, oldName)
+	if err != nil {
+		return err
+	}
+	if node.shared || node.isRoot() {
+		return os.ErrPermission
+	}
+	parentID, base, err := resolveMountParent(user, newName)
+	if err != nil {
+		return err
+	}
+	if _, ok := findChildFolder(user.ID, parentID, base); ok {
+		return os.ErrExist
+	}
+	if _, ok := findFolderFile(user.ID, parentID, base); ok {
+		return os.ErrExist
+	}
+
+	if node.File != nil {
+		if checkMoveRetained([]File{*node.File}, node.File.FolderID, parentID) != nil ||
+			checkFolderMetadata(DB, []File{*node.File}, parentID) != nil {
+			return os.ErrPermission
+		}
+		return DB.Model(node.File).Updates(map[string]interface{}{"filename": base, "folder_id": parentID}).Error
+	}
+	below := folderDescendantIDs(node.Folder.ID)
+	if parentID != nil && slices.Contains(below, *parentID) {
+		return os.ErrInvalid
+	}
+	var files []File
+	DB.Where("folder_id IN ?", below).Find(&files)
+	if checkMoveRetained(files, node.Folder.ParentID, parentID) != nil ||
+		checkMovedFolderMetadata(DB, *node.Folder, files, parentID) != nil {
+		return os.ErrPermission
+	}
+	return DB.Model(node.Folder).Updates(map[string]interface{}{"name": base, "parent_id": parentID}).Error
+}
+
+// davDir lists a folder, the root or the shared tree.
+type davDir struct {
+	user    User
+	node    davNode
+	entries []os.FileInfo
+	loaded  bool
+	pos     int
+}
+
+func (d *davDir) load() {
+	if d.loaded {
+		return
+	}
+	d.loaded = true
+	d.entries = listMountDir(d.user, d.node)
+}
+
+// listMountDir describes the entries of a folder, the root (which also shows
+// the shared tree when anything is shared with the user) or the shared tree.
+func listMountDir(user User, node davNode) []os.FileInfo {
+	var entries []os.FileInfo
+	var folders []Folder
+	var files []File
+	switch {
+	case node.sharedRoot:
+		folders, files = sharedWithUser(user)
+	case node.isRoot():
+		folders, files = listFolderChildren(user.ID, nil)
+		if sf, sfiles := sharedWithUser(user); len(sf)+len(sfiles) > 0 {
+			entries = append(entries, davNode{shared: true, sharedRoot: true}.info())
+		}
+	default:
+		folders, files = listFolderChildren(node.Folder.UploaderID, &node.Folder.ID)
+	}
+	for i := range folders {
+		entries = append(entries, davNode{vaultNode: vaultNode{Folder: &folders[i]}}.info())
+	}
+	for i := range files {
+		entries = append(entries, davNode{vaultNode: vaultNode{File: &files[i]}}.info())
+	}
+	return entries
+}
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	d.load()
+	if count <= 0 {
+		rest := d.entries[d.pos:]
+		d.pos = len(d.entries)
+		return rest, nil
+	}
+	if d.pos >= len(d.entries) {
+		return nil, io.EOF
+	}
+	end := min(d.pos+count, len(d.entries))
+	page := d.entries[d.pos:end]
+	d.pos = end
+	return page, nil
+}
+
+func (d *davDir) Stat() (os.FileInfo, error)                   { return d.node.info(), nil }
+func (d *davDir) Read([]byte) (int, error)                     { return 0, errDavIsDir }
+func (d *davDir) Write([]byte) (int, error)                    { return 0, errDavIsDir }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *davDir) Close() error                                 { return nil }
+
+// davReader serves a blob under the file's vault name.
+type davReader struct {
+	*os.File
+	info davFileInfo
+}
+
+func (r *davReader) Stat() (os.FileInfo, error)               { return r.info, nil }
+func (r *davReader) Write([]byte) (int, error)                { return 0, os.ErrPermission }
+func (r *davReader) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+// davWriter buffers an upload in a temp file and, on Close, stores it
+// through the same hashing and dedup path as UploadHandler.
+type davWriter struct {
+	tmp      *os.File
+	user     User
+	folderID *uint
+	name     string
+	existing *File
+}
+
+func (w *davWriter) Write(p []byte) (int, error) {
+	return w.tmp.Write(p)
+}
+
+func (w *davWriter) Stat() (os.FileInfo, error) {
+	info, err := w.tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{name: w.name, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func (w *davWriter) Close() error {
+	tmpPath := w.tmp.Name()
+	if err := w.tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if w.existing != nil {
+		blob, err := storeBlob(tmpPath, "")
+		if err != nil {
+			return err
+		}
+		_, err = addFileVersion(*w.existing, blob, w.user)
+		return err
+	}
+	_, _, err := ingestUpload(w.user, tmpPath, w.name, "", w.folderID)
+	return err
+}
+
+func (w *davWriter) Read([]byte) (int, error)                     { return 0, os.ErrPermission }
+func (w *davWriter) Readdir(count int) ([]os.FileInfo, error)     { return nil, os.ErrInvalid }
+func (w *davWriter) Seek(offset int64, whence int) (int64, error) { return w.tmp.Seek(offset, whence) }